@@ -0,0 +1,234 @@
+package hekalocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// decodeError describes a problem found while decoding a message. It is stored in the message as
+// the repeated decode_error, decode_error.kind, decode_error.offset and decode_error.path fields,
+// one value in each per error.
+type decodeError struct {
+	Kind   string
+	Offset int64 // Byte offset into the payload, or -1 if unknown.
+	Path   string
+	Err    error
+}
+
+func (e *decodeError) Error() string {
+	return e.Err.Error()
+}
+
+func newDecodeError(kind, path string, err error) *decodeError {
+	return &decodeError{Kind: kind, Offset: -1, Path: path, Err: err}
+}
+
+// asDecodeError wraps errors from encoding/json with their kind and offset.
+func asDecodeError(err error) *decodeError {
+	switch t := err.(type) {
+	case *decodeError:
+		return t
+	case *json.SyntaxError:
+		return &decodeError{Kind: "syntax", Offset: t.Offset, Err: err}
+	case *json.UnmarshalTypeError:
+		return &decodeError{Kind: "type", Offset: t.Offset, Err: err}
+	}
+	return newDecodeError("decode", "", err)
+}
+
+// decodeErrorPayload controls how much of the original payload is stored alongside decode errors.
+type decodeErrorPayload struct {
+	mode      string
+	maxLength int
+}
+
+// newDecodeErrorPayload validates the decode_error_payload setting, which is one of "keep" (the
+// default), "truncate" (to maxLength bytes, 1024 if unset) or "drop".
+func newDecodeErrorPayload(mode string, maxLength int) (*decodeErrorPayload, error) {
+	switch mode {
+	case "":
+		mode = "keep"
+	case "keep", "drop":
+	case "truncate":
+		if maxLength <= 0 {
+			maxLength = 1024
+		}
+	default:
+		return nil, fmt.Errorf("Unknown decode_error_payload: %s", mode)
+	}
+	return &decodeErrorPayload{mode, maxLength}, nil
+}
+
+// addDecodeError records err in the decode_error fields of msg, along with a copy of the payload
+// in the payload field unless there is one already.
+func (p *decodeErrorPayload) addDecodeError(msg *message.Message, err error) error {
+	if err := addDecodeErrorFields(msg, err); err != nil {
+		return err
+	}
+	if p.mode == "drop" {
+		return nil
+	}
+	payload := p.truncate(msg.GetPayload())
+	if field := msg.FindFirstField("payload"); field != nil && field.GetValueType() == message.Field_STRING {
+		for _, val := range field.GetValueString() {
+			if val == payload {
+				return nil
+			}
+		}
+	}
+	return appendFieldValue(msg, "payload", payload)
+}
+
+// addDecodeErrorFields records err in the decode_error fields of msg without copying the payload,
+// for errors that don't fail the message.
+func addDecodeErrorFields(msg *message.Message, err error) error {
+	de := asDecodeError(err)
+	for _, f := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"decode_error", de.Error()},
+		{"decode_error.kind", de.Kind},
+		{"decode_error.offset", de.Offset},
+		{"decode_error.path", de.Path},
+	} {
+		if err := appendFieldValue(msg, f.name, f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replacePayload replaces the payload of msg, along with the copy of the original stored in the
+// payload field by addDecodeError, so that the original doesn't leave the decoder.
+func (p *decodeErrorPayload) replacePayload(msg *message.Message, payload string) {
+	original := p.truncate(msg.GetPayload())
+	msg.SetPayload(payload)
+	if field := msg.FindFirstField("payload"); field != nil && field.GetValueType() == message.Field_STRING {
+		vals := field.GetValueString()
+		for i, val := range vals {
+			if val == original {
+				vals[i] = p.truncate(payload)
+			}
+		}
+	}
+}
+
+// truncate shortens payload to at most maxLength bytes in "truncate" mode, without splitting a
+// UTF-8 sequence.
+func (p *decodeErrorPayload) truncate(payload string) string {
+	if p.mode != "truncate" || len(payload) <= p.maxLength {
+		return payload
+	}
+	end := p.maxLength
+	for end > 0 && !utf8.RuneStart(payload[end]) {
+		end--
+	}
+	return payload[:end]
+}
+
+// appendFieldValue adds value to the named field, creating the field if it doesn't exist yet.
+func appendFieldValue(msg *message.Message, name string, value interface{}) error {
+	if field := msg.FindFirstField(name); field != nil {
+		return field.AddValue(value)
+	}
+	field, err := message.NewField(name, value, "")
+	if err != nil {
+		return err
+	}
+	msg.AddField(field)
+	return nil
+}
+
+// failurePolicy decides what happens to packs that failed to decode. In "tag" mode they keep
+// their decode_error fields and get the error type and logger, in "drop" mode they are discarded,
+// and in "error" mode the failure is returned as a Decoder error.
+type failurePolicy struct {
+	errorType   string
+	errorLogger string
+	mode        string
+}
+
+func newFailurePolicy(errorType, errorLogger, mode, defaultMode string) (*failurePolicy, error) {
+	if mode == "" {
+		mode = defaultMode
+	}
+	switch mode {
+	case "tag", "drop", "error":
+	default:
+		return nil, fmt.Errorf("Unknown fail_mode: %s", mode)
+	}
+	return &failurePolicy{errorType, errorLogger, mode}, nil
+}
+
+func (fp *failurePolicy) retag(msg *message.Message) {
+	if fp.errorType != "" {
+		msg.SetType(fp.errorType)
+	}
+	if fp.errorLogger != "" {
+		msg.SetLogger(fp.errorLogger)
+	}
+}
+
+// filter applies the policy to packs, where failures holds the decode failure of each pack, or
+// nil if it decoded cleanly. The first pack must be the one passed to Decode; it is never recycled
+// here, since the runner takes care of it when no packs are returned.
+func (fp *failurePolicy) filter(packs []*pipeline.PipelinePack, failures []error) ([]*pipeline.PipelinePack, error) {
+	switch fp.mode {
+	case "error":
+		for _, failure := range failures {
+			if failure != nil {
+				recycleExtras(packs)
+				return nil, failure
+			}
+		}
+	case "tag":
+		for i, failure := range failures {
+			if failure != nil {
+				fp.retag(packs[i].Message)
+			}
+		}
+	case "drop":
+		var kept []*pipeline.PipelinePack
+		for i, p := range packs {
+			if failures[i] == nil {
+				kept = append(kept, p)
+			} else if i > 0 {
+				p.Recycle(nil)
+			}
+		}
+		if len(kept) == 0 {
+			return nil, nil
+		}
+		// Keep the original pack first by moving the first surviving message into it.
+		if kept[0] != packs[0] {
+			packs[0].Message, kept[0].Message = kept[0].Message, packs[0].Message
+			kept[0].Recycle(nil)
+			kept[0] = packs[0]
+		}
+		return kept, nil
+	}
+	return packs, nil
+}
+
+// recycleExtras gives back every pack but the original one, which the runner recycles itself.
+func recycleExtras(packs []*pipeline.PipelinePack) {
+	for _, p := range packs[1:] {
+		p.Recycle(nil)
+	}
+}
+
+// newDecodeFailure returns the errors recorded in msg's decode_error field beyond the first
+// skip values as a single error, or nil if there are none.
+func newDecodeFailure(msg *message.Message, skip int) error {
+	errs := msg.FindFirstField("decode_error").GetValueString()
+	if len(errs) <= skip {
+		return nil
+	}
+	return fmt.Errorf("Decode error: %s", strings.Join(errs[skip:], "; "))
+}
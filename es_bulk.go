@@ -0,0 +1,152 @@
+package hekalocal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// bulkHeader renders the action and metadata line that precedes each document in an
+// Elasticsearch bulk request. Every metadata setting is a template interpolated with %{Name}
+// from the message headers and fields; values that interpolate to nothing are left out.
+type bulkHeader struct {
+	action      string
+	index       string
+	docType     string
+	id          string
+	routing     string
+	parent      string
+	version     string
+	versionType string
+	pipeline    string
+	omitType    bool
+
+	processingTime bool
+}
+
+func newBulkHeader(conf *JSONEncoderConfig) (*bulkHeader, error) {
+	action := conf.ElasticsearchAction
+	switch action {
+	case "":
+		action = "index"
+	case "index", "create", "update", "delete":
+	default:
+		return nil, fmt.Errorf("Unknown elasticsearch_action: %s", action)
+	}
+
+	omitType := conf.ElasticsearchOmitType || conf.ElasticsearchDataStream
+	if conf.ElasticsearchDataStream {
+		if conf.ElasticsearchAction == "" {
+			action = "create"
+		} else if action != "create" {
+			return nil, fmt.Errorf("Data streams only support the create action, not %s", action)
+		}
+	}
+	if omitType && conf.ElasticsearchParent != "" {
+		return nil, fmt.Errorf("elasticsearch_parent isn't supported without types")
+	}
+
+	for _, template := range []string{
+		conf.ElasticsearchIndex, conf.ElasticsearchType, conf.ElasticsearchID, conf.ElasticsearchRouting,
+		conf.ElasticsearchParent, conf.ElasticsearchDocVersion, conf.ElasticsearchDocVersionType, conf.ElasticsearchPipeline,
+	} {
+		if err := validateTemplate(template); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkStrftimeFormat(conf.ElasticsearchIndex, true); err != nil {
+		return nil, err
+	}
+
+	return &bulkHeader{
+		action:      action,
+		index:       conf.ElasticsearchIndex,
+		docType:     conf.ElasticsearchType,
+		id:          conf.ElasticsearchID,
+		routing:     conf.ElasticsearchRouting,
+		parent:      conf.ElasticsearchParent,
+		version:     conf.ElasticsearchDocVersion,
+		versionType: conf.ElasticsearchDocVersionType,
+		pipeline:    conf.ElasticsearchPipeline,
+		omitType:    omitType,
+
+		processingTime: conf.ElasticsearchIndexProcessingTime,
+	}, nil
+}
+
+// write adds the header line for msg to buf.
+func (h *bulkHeader) write(msg *message.Message, buf *bytes.Buffer) error {
+	meta := map[string]interface{}{"_index": h.indexName(msg)}
+	if !h.omitType {
+		meta["_type"] = interpolateMeta(h.docType, msg)
+	}
+	for _, m := range []struct {
+		key      string
+		template string
+	}{
+		{"_id", h.id},
+		{h.metaKey("routing"), h.routing},
+		{"_parent", h.parent},
+		{h.metaKey("version_type"), h.versionType},
+		{"pipeline", h.pipeline},
+	} {
+		if val := interpolateMeta(m.template, msg); val != "" {
+			meta[m.key] = val
+		}
+	}
+
+	if version := interpolateMeta(h.version, msg); version != "" {
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid Elasticsearch document version: %s", version)
+		}
+		meta[h.metaKey("version")] = v
+	}
+
+	if _, hasID := meta["_id"]; !hasID && (h.action == "update" || h.action == "delete") {
+		return fmt.Errorf("Elasticsearch %s action requires a document id", h.action)
+	}
+
+	enc, err := json.Marshal(map[string]interface{}{h.action: meta})
+	if err != nil {
+		return err
+	}
+	buf.Write(enc)
+	buf.WriteString("\n")
+	return nil
+}
+
+// metaKey returns the bulk metadata key for name, which has a leading underscore before
+// Elasticsearch 7.
+func (h *bulkHeader) metaKey(name string) string {
+	if h.omitType {
+		return name
+	}
+	return "_" + name
+}
+
+// indexName formats the index template with strftime over the message timestamp (or the current
+// time, with processing time enabled), then interpolates it. Names that are neither headers nor
+// fields and have no default are treated as Go time layouts, so "heka-%{2006.01}" still works.
+func (h *bulkHeader) indexName(msg *message.Message) string {
+	t := time.Unix(0, msg.GetTimestamp()).UTC()
+	if h.processingTime {
+		t = time.Now().UTC()
+	}
+	index, _ := interpolateFunc(formatTime(h.index, t), msg, t.Format)
+	return strings.ToLower(index)
+}
+
+// interpolateMeta interpolates template, returning an empty string if any value is missing.
+func interpolateMeta(template string, msg *message.Message) string {
+	val, missing := interpolate(template, msg)
+	if len(missing) > 0 {
+		return ""
+	}
+	return val
+}
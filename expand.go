@@ -0,0 +1,94 @@
+package hekalocal
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type expandPath struct {
+	path string
+	re   *regexp.Regexp
+}
+
+// jsonExpander replaces string values holding JSON-encoded objects or arrays with the decoded
+// values. Strings found inside expanded values are expanded in turn, if they match, up to
+// maxDepth levels.
+type jsonExpander struct {
+	paths    []expandPath
+	maxDepth int
+}
+
+func newJSONExpander(paths []string, maxDepth int) (*jsonExpander, error) {
+	if maxDepth < 0 {
+		return nil, fmt.Errorf("expand_json_max_depth must not be negative")
+	}
+	if maxDepth == 0 {
+		maxDepth = 1
+	}
+	e := &jsonExpander{maxDepth: maxDepth}
+	for _, path := range paths {
+		re, err := compilePathPattern(path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expand_json_fields path %s: %s", path, err.Error())
+		}
+		if re == nil {
+			if _, err = parsePath(path); err != nil {
+				return nil, err
+			}
+		}
+		e.paths = append(e.paths, expandPath{path, re})
+	}
+	return e, nil
+}
+
+// enabled reports whether there is anything to expand.
+func (e *jsonExpander) enabled() bool {
+	return len(e.paths) > 0
+}
+
+// expand expands the matching strings in m, one level of nesting at a time. Strings that aren't a
+// JSON object or array are left as they are and returned as errors of kind "expand".
+func (e *jsonExpander) expand(m map[string]interface{}) []*decodeError {
+	var errs []*decodeError
+	failed := make(map[string]bool)
+	for depth := 0; depth < e.maxDepth; depth++ {
+		var paths []string
+		for _, p := range e.paths {
+			if p.re == nil {
+				paths = append(paths, p.path)
+			} else {
+				paths = append(paths, matchPaths(m, p.re)...)
+			}
+		}
+
+		expanded := 0
+		for _, path := range paths {
+			val, exists := dottedGet(m, path)
+			s, isString := val.(string)
+			if !exists || !isString || failed[path] {
+				continue
+			}
+			var decoded interface{}
+			err := unmarshalJSON(s, &decoded)
+			if err == nil {
+				switch decoded.(type) {
+				case map[string]interface{}, []interface{}:
+				default:
+					err = fmt.Errorf("not a JSON object or array")
+				}
+			}
+			if err != nil {
+				failed[path] = true
+				errs = append(errs, newDecodeError("expand", path,
+					fmt.Errorf("Cannot expand JSON at %s: %s", path, err.Error())))
+				continue
+			}
+			dottedSet(m, path, decoded)
+			expanded++
+		}
+		if expanded == 0 {
+			break
+		}
+	}
+	return errs
+}
@@ -2,31 +2,168 @@ package hekalocal
 
 import (
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
 	"time"
 
+	"github.com/cespare/xxhash"
+
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
 // HashUUIDDecoder sets the UUID to a hashed combination of the timestamp and payload.
 type HashUUIDDecoder struct {
 	Timestamp time.Time // Hard-code the timestamp for testing
+
+	config        *HashUUIDDecoderConfig
+	hasher        *uuidHasher
+	newUUID       uuidGenerator
+	errorPayload  *decodeErrorPayload
+	failurePolicy *failurePolicy
+}
+
+// HashUUIDDecoderConfig contains the options for what gets hashed into the UUID and for handling
+// messages that can't be hashed.
+type HashUUIDDecoderConfig struct {
+	// Hash function used: "md5" (the default), "sha1", "sha256", "xxhash" or "fnv".
+	HashAlgorithm string `toml:"hash_algorithm"`
+	// Message headers or fields to hash instead of the payload, e.g. ["Type", "user_id"].
+	HashFields []string `toml:"hash_fields"`
+	// Template interpolated with %{Name} message values to hash instead of the payload.
+	HashTemplate string `toml:"hash_template"`
+	// Salt hashed ahead of the input, so different pipelines never produce the same UUIDs.
+	HashNamespace string `toml:"hash_namespace"`
+	// Layout of the generated UUID: "legacy-v1" (the default), "v5" (SHA-1 of the hash within
+	// uuid_namespace), "v7" (Unix milliseconds then hash) or "v8" (version 1 time fields then hash).
+	UUIDMode      string `toml:"uuid_mode"`
+	UUIDNamespace string `toml:"uuid_namespace"`
+
+	// Messages with nothing to hash get this type and logger. The fail_mode decides whether they
+	// are then passed on ("tag", the default), dropped ("drop"), or returned as an error ("error").
+	// Unless one of these is set, such messages are passed on unchanged, as they always have been.
+	ErrorType   string `toml:"error_type"`
+	ErrorLogger string `toml:"error_logger"`
+	FailMode    string `toml:"fail_mode"`
+}
+
+// ConfigStruct is provided to make HashUUIDDecoder implement the Heka pipeline.HasConfigStruct interface.
+func (d *HashUUIDDecoder) ConfigStruct() interface{} {
+	return new(HashUUIDDecoderConfig)
 }
 
 // Init is provided to make HashUUIDDecoder implement the Heka pipeline.Plugin interface.
 func (d *HashUUIDDecoder) Init(config interface{}) (err error) {
+	if config == nil {
+		config = d.ConfigStruct()
+	}
+	d.config = config.(*HashUUIDDecoderConfig)
+	d.hasher, err = newUUIDHasher(d.config.HashAlgorithm, d.config.HashNamespace, d.config.HashFields, d.config.HashTemplate)
+	if err != nil {
+		return
+	}
+	d.newUUID, err = newUUIDGenerator(d.config.UUIDMode, d.config.UUIDNamespace)
+	if err != nil {
+		return
+	}
+	d.errorPayload, _ = newDecodeErrorPayload("drop", 0)
+	d.failurePolicy, err = newFailurePolicy(d.config.ErrorType, d.config.ErrorLogger, d.config.FailMode, "tag")
 	return
 }
 
 // Decode is provided to make HashUUIDDecoder implement the Heka pipeline.Decoder interface.
 func (d *HashUUIDDecoder) Decode(pack *pipeline.PipelinePack) (packs []*pipeline.PipelinePack, err error) {
+	if d.config == nil {
+		if err = d.Init(nil); err != nil {
+			return
+		}
+	}
 	ts := pack.Message.GetTimestamp()
 	if !d.Timestamp.IsZero() {
 		ts = d.Timestamp.UnixNano()
 	}
-	hash := md5.Sum([]byte(pack.Message.GetPayload()))
-	pack.Message.SetUuid([]byte(NewTimestampUUID(ts, hash[0:])))
-	packs = append(packs, pack)
-	return
+	hash, failure := d.hasher.sum(pack.Message)
+	pack.Message.SetUuid([]byte(d.newUUID(ts, hash)))
+	if d.config.ErrorType == "" && d.config.ErrorLogger == "" && d.config.FailMode == "" {
+		failure = nil
+	}
+
+	if failure != nil {
+		if err = d.errorPayload.addDecodeError(pack.Message, failure); err != nil {
+			return
+		}
+	}
+	return d.failurePolicy.filter([]*pipeline.PipelinePack{pack}, []error{failure})
+}
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"xxhash": func() hash.Hash { return xxhash.New() },
+	"fnv":    func() hash.Hash { return fnv.New64a() },
+}
+
+// uuidHasher hashes the parts of a message that identify it, for use in NewTimestampUUID.
+type uuidHasher struct {
+	newHash   func() hash.Hash
+	namespace string
+	fields    []string
+	template  string
+}
+
+func newUUIDHasher(algorithm, namespace string, fields []string, template string) (*uuidHasher, error) {
+	if algorithm == "" {
+		algorithm = "md5"
+	}
+	newHash, ok := hashAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("Unknown hash_algorithm: %s", algorithm)
+	}
+	if len(fields) > 0 && template != "" {
+		return nil, errors.New("Only one of hash_fields and hash_template may be set")
+	}
+	return &uuidHasher{newHash, namespace, fields, template}, nil
+}
+
+// sum hashes the namespace followed by the template, the fields, or the payload, in that order of
+// preference. The hash is still returned along with an error when there was nothing to hash.
+func (h *uuidHasher) sum(msg *message.Message) ([]byte, error) {
+	hash := h.newHash()
+	if h.namespace != "" {
+		hash.Write([]byte(h.namespace))
+		hash.Write([]byte{0})
+	}
+
+	var empty bool
+	switch {
+	case h.template != "":
+		input, missing := interpolate(h.template, msg)
+		hash.Write([]byte(input))
+		empty = len(missing) > 0 && input == ""
+	case len(h.fields) > 0:
+		empty = true
+		for _, name := range h.fields {
+			val, ok := messageValue(msg, name)
+			empty = empty && !ok
+			hash.Write([]byte(name + "=" + val))
+			hash.Write([]byte{0})
+		}
+	default:
+		payload := msg.GetPayload()
+		hash.Write([]byte(payload))
+		empty = payload == ""
+	}
+
+	if empty {
+		// Every message with nothing to hash would get the same UUID for a given timestamp.
+		return hash.Sum(nil), newDecodeError("hash", "", errors.New("Nothing to hash for the UUID"))
+	}
+	return hash.Sum(nil), nil
 }
 
 func init() {
@@ -1,11 +1,15 @@
 package hekalocal_test
 
 import (
+	"encoding/binary"
 	"testing"
 	"time"
 
 	"github.com/OwnLocal/heka-plugins"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/onsi/gomega"
+	"github.com/pborman/uuid"
 )
 
 func TestHashUUIDDecoder(t *testing.T) {
@@ -24,3 +28,131 @@ func TestHashUUIDDecoder(t *testing.T) {
 		Expect(dt.pack.Message.GetUuidString()).To(Equal(c.wantUUID))
 	}
 }
+
+func TestHashUUIDDecoderEmptyPayload(t *testing.T) {
+	cases := []struct {
+		mode      string
+		wantPacks int
+		wantErr   bool
+	}{
+		{"", 1, false},
+		{"drop", 0, false},
+		{"error", 0, true},
+	}
+
+	// Without any dead-letter settings the message is passed on untouched.
+	dt := newDecoderTester(t, &hekalocal.HashUUIDDecoder{}, nil)
+	dt.testDecode("", nil)
+	Expect(dt.pack.Message.GetType()).To(Equal(""))
+
+	for _, c := range cases {
+		dt := newDecoderTester(t, &hekalocal.HashUUIDDecoder{}, &hekalocal.HashUUIDDecoderConfig{ErrorType: "unhashable", FailMode: c.mode})
+		payload := ""
+		pack := &pipeline.PipelinePack{Message: &message.Message{Payload: &payload}}
+		packs, err := dt.decoder.Decode(pack)
+		Expect(packs).To(HaveLen(c.wantPacks))
+		Expect(err != nil).To(Equal(c.wantErr))
+		if c.wantPacks > 0 {
+			Expect(packs[0].Message.GetType()).To(Equal("unhashable"))
+			Expect(packs[0].Message.FindFirstField("decode_error.kind").GetValue()).To(Equal("hash"))
+		}
+	}
+}
+
+func TestHashUUIDDecoderOptions(t *testing.T) {
+	ts := time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC)
+	uuidFor := func(conf *hekalocal.HashUUIDDecoderConfig, msg *message.Message) string {
+		dt := newDecoderTester(t, &hekalocal.HashUUIDDecoder{Timestamp: ts}, conf)
+		packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: msg})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packs[0].Message.FindFirstField("decode_error")).To(BeNil())
+		return packs[0].Message.GetUuidString()
+	}
+	newMsg := func(payload, user string) *message.Message {
+		msg := &message.Message{}
+		msg.SetPayload(payload)
+		msg.SetType("login")
+		message.NewStringField(msg, "user", user)
+		return msg
+	}
+
+	// The default configuration hashes the payload with MD5, as before.
+	Expect(uuidFor(&hekalocal.HashUUIDDecoderConfig{}, newMsg(`{"timestamp": "2015-10-10T10:10:10Z"}`, "a"))).
+		To(Equal("16bc6d00-6f37-11e5-804b-7f8b32bc10ae"))
+
+	seen := map[string]bool{}
+	for _, algorithm := range []string{"md5", "sha1", "sha256", "xxhash", "fnv"} {
+		u := uuidFor(&hekalocal.HashUUIDDecoderConfig{HashAlgorithm: algorithm}, newMsg("payload", "a"))
+		Expect(seen).NotTo(HaveKey(u))
+		seen[u] = true
+	}
+
+	fieldsConf := &hekalocal.HashUUIDDecoderConfig{HashFields: []string{"Type", "user"}}
+	Expect(uuidFor(fieldsConf, newMsg("ingested at 1", "a"))).To(Equal(uuidFor(fieldsConf, newMsg("ingested at 2", "a"))))
+	Expect(uuidFor(fieldsConf, newMsg("ingested at 1", "a"))).NotTo(Equal(uuidFor(fieldsConf, newMsg("ingested at 1", "b"))))
+
+	templateConf := &hekalocal.HashUUIDDecoderConfig{HashTemplate: "%{Type}/%{user}"}
+	Expect(uuidFor(templateConf, newMsg("x", "a"))).To(Equal(uuidFor(templateConf, newMsg("y", "a"))))
+	Expect(uuidFor(templateConf, newMsg("x", "a"))).NotTo(Equal(uuidFor(templateConf, newMsg("x", "b"))))
+
+	Expect(uuidFor(&hekalocal.HashUUIDDecoderConfig{HashNamespace: "pipeline-a"}, newMsg("x", "a"))).
+		NotTo(Equal(uuidFor(&hekalocal.HashUUIDDecoderConfig{HashNamespace: "pipeline-b"}, newMsg("x", "a"))))
+}
+
+func TestHashUUIDDecoderBadConfig(t *testing.T) {
+	RegisterTestingT(t)
+	for _, conf := range []*hekalocal.HashUUIDDecoderConfig{
+		{HashAlgorithm: "crc32"},
+		{HashFields: []string{"a"}, HashTemplate: "%{a}"},
+	} {
+		Expect((&hekalocal.HashUUIDDecoder{}).Init(conf)).To(HaveOccurred())
+	}
+}
+
+func TestHashUUIDDecoderModes(t *testing.T) {
+	ts := time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC)
+	decode := func(conf *hekalocal.HashUUIDDecoderConfig, at time.Time, payload string) uuid.UUID {
+		dt := newDecoderTester(t, &hekalocal.HashUUIDDecoder{Timestamp: at}, conf)
+		packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+		Expect(err).NotTo(HaveOccurred())
+		return uuid.UUID(packs[0].Message.GetUuid())
+	}
+
+	legacy := decode(&hekalocal.HashUUIDDecoderConfig{UUIDMode: "legacy-v1"}, ts, `{"timestamp": "2015-10-10T10:10:10Z"}`)
+	Expect(legacy.String()).To(Equal("16bc6d00-6f37-11e5-804b-7f8b32bc10ae"))
+
+	for _, algorithm := range []string{"md5", "fnv"} {
+		v5 := decode(&hekalocal.HashUUIDDecoderConfig{UUIDMode: "v5", HashAlgorithm: algorithm}, ts, "payload")
+		Expect(uuidVersion(v5)).To(Equal(uuid.Version(5)))
+		Expect(v5.Variant()).To(Equal(uuid.RFC4122))
+		Expect(decode(&hekalocal.HashUUIDDecoderConfig{UUIDMode: "v5", HashAlgorithm: algorithm}, ts.Add(time.Hour), "payload")).To(Equal(v5))
+		Expect(decode(&hekalocal.HashUUIDDecoderConfig{UUIDMode: "v5", HashAlgorithm: algorithm, UUIDNamespace: uuid.NameSpace_URL.String()}, ts, "payload")).NotTo(Equal(v5))
+
+		v7 := decode(&hekalocal.HashUUIDDecoderConfig{UUIDMode: "v7", HashAlgorithm: algorithm}, ts, "payload")
+		Expect(uuidVersion(v7)).To(Equal(uuid.Version(7)))
+		Expect(v7.Variant()).To(Equal(uuid.RFC4122))
+		ms := int64(binary.BigEndian.Uint16(v7[0:]))<<32 | int64(binary.BigEndian.Uint32(v7[2:]))
+		Expect(ms).To(Equal(ts.UnixNano() / int64(time.Millisecond)))
+		Expect(decode(&hekalocal.HashUUIDDecoderConfig{UUIDMode: "v7", HashAlgorithm: algorithm}, ts, "other")).NotTo(Equal(v7))
+
+		v8 := decode(&hekalocal.HashUUIDDecoderConfig{UUIDMode: "v8", HashAlgorithm: algorithm}, ts, "payload")
+		Expect(uuidVersion(v8)).To(Equal(uuid.Version(8)))
+		Expect(v8.Variant()).To(Equal(uuid.RFC4122))
+		Expect(v8[:6]).To(Equal(legacy[:6]))
+	}
+}
+
+func TestHashUUIDDecoderBadMode(t *testing.T) {
+	RegisterTestingT(t)
+	for _, conf := range []*hekalocal.HashUUIDDecoderConfig{
+		{UUIDMode: "v4"},
+		{UUIDMode: "v5", UUIDNamespace: "not-a-uuid"},
+	} {
+		Expect((&hekalocal.HashUUIDDecoder{}).Init(conf)).To(HaveOccurred())
+	}
+}
+
+func uuidVersion(u uuid.UUID) uuid.Version {
+	v, _ := u.Version()
+	return v
+}
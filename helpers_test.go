@@ -88,6 +88,20 @@ func (dt *decoderTester) testDecodeError(payload string, errorMatcher types.Gome
 	return err
 }
 
+// packSupplier stands in for the DecoderRunner handed to decoders that emit extra packs.
+type packSupplier struct {
+	pipeline.DecoderRunner
+	recycleChan chan *pipeline.PipelinePack
+}
+
+func newPackSupplier() *packSupplier {
+	return &packSupplier{recycleChan: make(chan *pipeline.PipelinePack, 10)}
+}
+
+func (ps *packSupplier) NewPack() *pipeline.PipelinePack {
+	return pipeline.NewPipelinePack(ps.recycleChan)
+}
+
 type encoderTester struct {
 	t       *testing.T
 	encoder pipeline.Encoder
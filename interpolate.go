@@ -0,0 +1,143 @@
+package hekalocal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// messageValue returns the string form of a message header (Type, Logger, Hostname, Payload,
+// EnvVersion, Pid, Severity, Timestamp or UUID) or, failing that, of the dynamic field with the
+// given name. Repeated field values are joined with commas.
+func messageValue(msg *message.Message, name string) (string, bool) {
+	switch name {
+	case "Type":
+		return msg.GetType(), msg.Type != nil
+	case "Logger":
+		return msg.GetLogger(), msg.Logger != nil
+	case "Hostname":
+		return msg.GetHostname(), msg.Hostname != nil
+	case "Payload":
+		return msg.GetPayload(), msg.Payload != nil
+	case "EnvVersion":
+		return msg.GetEnvVersion(), msg.EnvVersion != nil
+	case "Pid":
+		return strconv.Itoa(int(msg.GetPid())), msg.Pid != nil
+	case "Severity":
+		return strconv.Itoa(int(msg.GetSeverity())), msg.Severity != nil
+	case "Timestamp":
+		return strconv.FormatInt(msg.GetTimestamp(), 10), msg.Timestamp != nil
+	case "UUID":
+		return msg.GetUuidString(), msg.Uuid != nil
+	}
+
+	field := msg.FindFirstField(name)
+	if field == nil {
+		return "", false
+	}
+	return fieldValueString(field), true
+}
+
+// fieldValueString formats every value of a field, joined with commas.
+func fieldValueString(field *message.Field) string {
+	var vals []string
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		vals = field.GetValueString()
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			vals = append(vals, string(v))
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			vals = append(vals, strconv.FormatInt(v, 10))
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			vals = append(vals, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			vals = append(vals, strconv.FormatBool(v))
+		}
+	}
+	return strings.Join(vals, ",")
+}
+
+// interpolate replaces each %{Name} in template with the message value of that name, returning
+// the names that couldn't be found. Missing values are replaced with an empty string.
+//
+// The name may be followed by filters separated by "|": "lowercase", "sanitize" (which replaces
+// characters that aren't allowed in Elasticsearch index names with "_"), and "default:value",
+// which supplies a value for when the name is missing.
+func interpolate(template string, msg *message.Message) (string, []string) {
+	return interpolateFunc(template, msg, func(string) string { return "" })
+}
+
+// interpolateFunc is like interpolate, but replaces missing values with the result of fallback.
+func interpolateFunc(template string, msg *message.Message, fallback func(name string) string) (string, []string) {
+	var (
+		out     []string
+		missing []string
+	)
+	for {
+		start := strings.Index(template, "%{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			break
+		}
+		filters := strings.Split(template[start+2:start+end], "|")
+		name := filters[0]
+		val, ok := messageValue(msg, name)
+		for _, filter := range filters[1:] {
+			switch {
+			case strings.HasPrefix(filter, "default:"):
+				if !ok {
+					val, ok = filter[len("default:"):], true
+				}
+			case filter == "lowercase":
+				val = strings.ToLower(val)
+			case filter == "sanitize":
+				val = indexNameSanitizer.Replace(val)
+			}
+		}
+		if !ok {
+			missing = append(missing, name)
+			val = fallback(name)
+		}
+		out = append(out, template[:start], val)
+		template = template[start+end+1:]
+	}
+	out = append(out, template)
+	return strings.Join(out, ""), missing
+}
+
+var indexNameSanitizer = strings.NewReplacer(
+	`\`, "_", "/", "_", "*", "_", "?", "_", `"`, "_", "<", "_", ">", "_",
+	"|", "_", " ", "_", ",", "_", "#", "_", ":", "_",
+)
+
+// validateTemplate checks that every filter used in template is known.
+func validateTemplate(template string) error {
+	for {
+		start := strings.Index(template, "%{")
+		if start < 0 {
+			return nil
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return nil
+		}
+		for _, filter := range strings.Split(template[start+2:start+end], "|")[1:] {
+			if filter != "lowercase" && filter != "sanitize" && !strings.HasPrefix(filter, "default:") {
+				return fmt.Errorf("Unknown interpolation filter %q in %s", filter, template)
+			}
+		}
+		template = template[start+end+1:]
+	}
+}
@@ -1,9 +1,14 @@
 package hekalocal
 
 import (
-	"crypto/md5"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +22,7 @@ import (
 // also optionally fills in the Timestamp, UUID, and Type message fields.
 type JSONDecoder struct {
 	config *JSONDecoderConfig
+	runner pipeline.DecoderRunner
 }
 
 type fieldDecoder func(*message.Message, *message.Field) error
@@ -38,26 +44,165 @@ type JSONDecoderConfig struct {
 	KeepFields       []string          `toml:"keep_fields"`
 	RemoveFields     []string          `toml:"remove_fields"`
 
+	// Only keep the kept and moved values, plus the header fields, and count the rest.
+	StrictKeepFields        bool   `toml:"strict_keep_fields"`
+	DroppedFieldsCountField string `toml:"dropped_fields_count_field"`
+
+	// Dotted paths mapped to "int", "double", "bool", "string", "bytes", "json" or "timestamp".
+	FieldTypes map[string]string `toml:"field_types"`
+
+	// Field names or globs mapped to the representation (units) set on the field.
+	FieldRepresentations map[string]string `toml:"field_representations"`
+
+	// Go layouts or strftime patterns tried in order for string timestamps. Defaults to RFC3339.
+	TimestampFormats []string `toml:"timestamp_formats"`
+	// Unit of numeric timestamps: "s", "ms", "us", "ns", or "auto" (the default).
+	TimestampUnit     string `toml:"timestamp_unit"`
+	TimestampTimezone string `toml:"timestamp_timezone"`
+
+	// Payload stored with decode errors: "keep" (the default), "truncate" or "drop".
+	DecodeErrorPayload       string `toml:"decode_error_payload"`
+	DecodeErrorPayloadLength int    `toml:"decode_error_payload_length"`
+
+	// Messages that fail to decode get this type and logger; fail_mode is "tag", "drop" or "error".
+	ErrorType   string `toml:"error_type"`
+	ErrorLogger string `toml:"error_logger"`
+	FailMode    string `toml:"fail_mode"`
+
 	// The message payload will be hashed and made into a UUID along with the timestamp.
-	HashUUID bool `toml:"hash_uuid"`
+	HashUUID      bool     `toml:"hash_uuid"`
+	HashAlgorithm string   `toml:"hash_algorithm"`
+	HashFields    []string `toml:"hash_fields"`
+	HashTemplate  string   `toml:"hash_template"`
+	HashNamespace string   `toml:"hash_namespace"`
+	UUIDMode      string   `toml:"uuid_mode"`
+	UUIDNamespace string   `toml:"uuid_namespace"`
+
+	// Extra or replacement severity names, matched case-insensitively.
+	SeverityNames map[string]int32 `toml:"severity_names"`
+
+	// A JSON Schema file, or dotted paths mapped to types, to validate decoded objects against.
+	SchemaFile   string            `toml:"schema_file"`
+	SchemaTypes  map[string]string `toml:"schema_types"`
+	SchemaStrict bool              `toml:"schema_strict"`
+
+	Redact RedactConfig `toml:"redact"`
+
+	// Named profiles, chosen by profile_field, message_matcher or default_profile.
+	Profiles       map[string]*JSONDecoderProfile `toml:"profiles"`
+	ProfileField   string                         `toml:"profile_field"`
+	DefaultProfile string                         `toml:"default_profile"`
+
+	// Paths whose JSON-encoded string values are decoded in place.
+	ExpandJSONFields   []string `toml:"expand_json_fields"`
+	ExpandJSONMaxDepth int      `toml:"expand_json_max_depth"`
+
+	// Split newline-delimited objects, or a top-level array, into one message each.
+	SplitPayload bool `toml:"split_payload"`
+
+	fieldMap          map[string]fieldDecoder
+	timestampLayouts  []string
+	timestampLocation *time.Location
+	repGlobs          []representationGlob
+	pathRules         []*pathRule
+	errorPayload      *decodeErrorPayload
+	valueErrorPayload *decodeErrorPayload
+	failurePolicy     *failurePolicy
+	hasher            *uuidHasher
+	newUUID           uuidGenerator
+	severities        *severityTable
+	redactor          *redactor
+	expander          *jsonExpander
+	schema            *schema
+	profiles          map[string]*JSONDecoderConfig
+	profileMatchers   []profileMatcher
+}
+
+// JSONDecoderProfile holds the settings that can be changed for a kind of event. Settings that
+// are left out are taken from the top-level configuration.
+type JSONDecoderProfile struct {
+	MessageMatcher string `toml:"message_matcher"`
+
+	TimestampField   string            `toml:"timestamp_field"`
+	UUIDField        string            `toml:"uuid_field"`
+	TypeField        string            `toml:"type_field"`
+	LoggerField      string            `toml:"logger_field"`
+	EnvVersionField  string            `toml:"env_version_field"`
+	HostnameField    string            `toml:"hostname_field"`
+	SeverityField    string            `toml:"severity_field"`
+	PIDField         string            `toml:"pid_field"`
+	Flatten          *bool             `toml:"flatten"`
+	FlattenPrefix    *string           `toml:"flatten_prefix"`
+	FlattenToStrings *bool             `toml:"flatten_to_strings"`
+	MoveFields       map[string]string `toml:"move_fields"`
+	KeepFields       []string          `toml:"keep_fields"`
+	RemoveFields     []string          `toml:"remove_fields"`
+	FieldTypes       map[string]string `toml:"field_types"`
+}
+
+type profileMatcher struct {
+	name    string
+	matcher *message.MatcherSpecification
+}
 
-	fieldMap map[string]fieldDecoder
+type representationGlob struct {
+	re             *regexp.Regexp
+	representation string
 }
 
 // Init is provided to make JSONDecoder implement the Heka pipeline.Plugin interface.
 func (jd *JSONDecoder) Init(config interface{}) (err error) {
 	jd.config = config.(*JSONDecoderConfig)
 	jd.config.buildFieldMap()
-	if jd.config.MoveFields == nil {
-		jd.config.MoveFields = make(map[string]string)
+	jd.config.errorPayload, err = newDecodeErrorPayload(jd.config.DecodeErrorPayload, jd.config.DecodeErrorPayloadLength)
+	if err != nil {
+		return
 	}
-	for _, path := range jd.config.KeepFields {
-		jd.config.MoveFields[path] = path
+	jd.config.failurePolicy, err = newFailurePolicy(jd.config.ErrorType, jd.config.ErrorLogger, jd.config.FailMode, "tag")
+	if err != nil {
+		return
 	}
-	for _, path := range jd.config.RemoveFields {
-		jd.config.MoveFields[path] = ""
+	jd.config.hasher, err = newUUIDHasher(jd.config.HashAlgorithm, jd.config.HashNamespace, jd.config.HashFields, jd.config.HashTemplate)
+	if err != nil {
+		return
 	}
-	return
+	jd.config.newUUID, err = newUUIDGenerator(jd.config.UUIDMode, jd.config.UUIDNamespace)
+	if err != nil {
+		return
+	}
+	if jd.config.severities, err = newSeverityTable(jd.config.SeverityNames); err != nil {
+		return
+	}
+	if jd.config.redactor, err = newRedactor(&jd.config.Redact); err != nil {
+		return
+	}
+	// Errors found after parsing don't keep a copy of a payload that is going to be redacted or cut
+	// down to the kept fields.
+	jd.config.valueErrorPayload = jd.config.errorPayload
+	if jd.config.redactor.enabled() || jd.config.StrictKeepFields {
+		jd.config.valueErrorPayload, _ = newDecodeErrorPayload("drop", 0)
+	}
+	if jd.config.expander, err = newJSONExpander(jd.config.ExpandJSONFields, jd.config.ExpandJSONMaxDepth); err != nil {
+		return
+	}
+	if err = jd.config.buildSchema(); err != nil {
+		return
+	}
+	if err = jd.config.buildTimestampParsing(); err != nil {
+		return
+	}
+	for path, fieldType := range jd.config.FieldTypes {
+		if !fieldTypes[fieldType] {
+			return fmt.Errorf("Unknown field type for %s: %s", path, fieldType)
+		}
+	}
+	if err = jd.config.buildRepresentations(); err != nil {
+		return
+	}
+	if jd.config.pathRules, err = buildPathRules(jd.config.MoveFields, jd.config.KeepFields, jd.config.RemoveFields); err != nil {
+		return
+	}
+	return jd.config.buildProfiles()
 }
 
 // ConfigStruct is provided to make JSONDecoder implement the Heka pipeline.HasConfigStruct interface.
@@ -65,159 +210,533 @@ func (jd *JSONDecoder) ConfigStruct() interface{} {
 	return new(JSONDecoderConfig)
 }
 
+// SetDecoderRunner is provided to make JSONDecoder implement the Heka pipeline.WantsDecoderRunner
+// interface. The runner supplies the extra packs needed when splitting payloads.
+func (jd *JSONDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
+	jd.runner = dr
+}
+
 // Decode is provided to make JSONDecoder implement the Heka pipeline.Decoder interface.
 func (jd *JSONDecoder) Decode(pack *pipeline.PipelinePack) (packs []*pipeline.PipelinePack, err error) {
 	packs = []*pipeline.PipelinePack{pack}
-	payload := pack.Message.GetPayload()
-	err = jd.decodeJSON(payload, pack.Message)
+	var segments []string
+	if jd.config.SplitPayload {
+		segments = splitJSONPayload(pack.Message.GetPayload())
+	}
+
+	// Copy the original message into each extra pack before anything is decoded into it.
+	for i := 1; i < len(segments); i++ {
+		extra := jd.newPack()
+		if extra == nil {
+			recycleExtras(packs)
+			return nil, errors.New("Unable to get a new pack for split payload")
+		}
+		pack.Message.Copy(extra.Message)
+		extra.Message.SetUuid(uuid.NewRandom())
+		packs = append(packs, extra)
+	}
+
+	failures := make([]error, len(packs))
+	for i, p := range packs {
+		if segments != nil {
+			p.Message.SetPayload(segments[i])
+		}
+		if failures[i], err = jd.decodePack(p); err != nil {
+			if len(packs) > 1 {
+				recycleExtras(packs)
+				return nil, err
+			}
+			return
+		}
+	}
+	return jd.config.failurePolicy.filter(packs, failures)
+}
+
+// decodePack decodes the pack's payload into its message, returning any decode errors that were
+// recorded as a failure.
+func (jd *JSONDecoder) decodePack(pack *pipeline.PipelinePack) (failure, err error) {
+	prevErrors := len(pack.Message.FindFirstField("decode_error").GetValueString())
+	dropped, err := jd.decodeJSON(pack.Message.GetPayload(), pack.Message)
+	if err != nil {
+		return
+	}
 	if jd.config.HashUUID {
-		hash := md5.Sum([]byte(payload))
-		pack.Message.SetUuid([]byte(NewTimestampUUID(pack.Message.GetTimestamp(), hash[0:])))
+		hash, hashErr := jd.config.hasher.sum(pack.Message)
+		pack.Message.SetUuid([]byte(jd.config.newUUID(pack.Message.GetTimestamp(), hash)))
+		if hashErr != nil {
+			if err = jd.config.valueErrorPayload.addDecodeError(pack.Message, hashErr); err != nil {
+				return
+			}
+		}
 	}
-	return
+	jd.config.redactor.redactPayload(pack.Message)
+	// Strings that couldn't be expanded and values dropped by a strict schema are reported, but
+	// don't fail the message.
+	if len(pack.Message.FindFirstField("decode_error").GetValueString())-prevErrors <= dropped {
+		return nil, nil
+	}
+	return newDecodeFailure(pack.Message, prevErrors), nil
 }
 
-func addDecodeError(msg *message.Message, jsonErr error) (err error) {
-	var field *message.Field
-	if field, err = message.NewField("decode_error", jsonErr.Error(), ""); err != nil {
-		return err
+// newPack fetches a pack from the router's input supply. Packs are never made outside the pool,
+// so there is no pack to be had without a runner.
+func (jd *JSONDecoder) newPack() *pipeline.PipelinePack {
+	if jd.runner == nil {
+		return nil
 	}
-	msg.AddField(field)
-	if field, err = message.NewField("payload", msg.GetPayload(), ""); err != nil {
-		return err
+	return jd.runner.NewPack()
+}
+
+// splitJSONPayload splits a payload containing a stream of JSON values into one string per value,
+// expanding top-level arrays into their elements. When a value can't be parsed, the rest of its
+// line is kept as a segment so that it gets tagged with the decode error, and splitting resumes
+// on the next line.
+func splitJSONPayload(payload string) []string {
+	var segments []string
+	r := strings.NewReader(payload)
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rest := new(bytes.Buffer)
+			io.Copy(rest, dec.Buffered())
+			io.Copy(rest, r)
+			line := strings.TrimLeft(rest.String(), " \t\r\n")
+			next := ""
+			if i := strings.IndexByte(line, '\n'); i >= 0 {
+				line, next = line[:i], line[i+1:]
+			}
+			segments = append(segments, strings.TrimSpace(line))
+			if strings.TrimSpace(next) != "" {
+				segments = append(segments, splitJSONPayload(next)...)
+			}
+			break
+		}
+
+		var elems []json.RawMessage
+		if raw[0] == '[' && json.Unmarshal(raw, &elems) == nil {
+			for _, elem := range elems {
+				segments = append(segments, string(elem))
+			}
+			continue
+		}
+		segments = append(segments, string(raw))
 	}
-	msg.AddField(field)
-	return nil
+
+	if len(segments) == 0 {
+		segments = []string{payload}
+	}
+	return segments
 }
 
-func (jd *JSONDecoder) decodeJSON(jsonStr string, msg *message.Message) error {
-	var err error
+// decodeJSON decodes jsonStr into msg, returning the number of decode errors recorded for strings
+// that couldn't be expanded and for values dropped by a strict schema.
+func (jd *JSONDecoder) decodeJSON(jsonStr string, msg *message.Message) (tolerated int, err error) {
 	rawMap := make(map[string]interface{})
-	if err := json.Unmarshal([]byte(jsonStr), &rawMap); err != nil {
-		return addDecodeError(msg, err)
+	if err := unmarshalJSON(jsonStr, &rawMap); err != nil {
+		return 0, jd.config.errorPayload.addDecodeError(msg, err)
+	}
+	if jd.config.expander.enabled() {
+		for _, expandErr := range jd.config.expander.expand(rawMap) {
+			if err = addDecodeErrorFields(msg, expandErr); err != nil {
+				return
+			}
+			tolerated++
+		}
 	}
+	conf := jd.config.profileFor(rawMap, msg)
 
-	moveMap := make(map[string]interface{}, len(jd.config.MoveFields))
-	for from, to := range jd.config.MoveFields {
-		val, exists := dottedRemove(rawMap, from)
+	if len(conf.redactor.rules) > 0 {
+		// Redact a copy for the payload, before field_types change how values are encoded.
+		if err = conf.redactPayloadJSON(rawMap, msg); err != nil {
+			return
+		}
+	}
+
+	for path, fieldType := range conf.FieldTypes {
+		val, exists := dottedGet(rawMap, path)
 		if !exists {
 			continue
 		}
-		if to != "" {
-			moveMap[to] = val
+		coerced, coerceErr := conf.coerceValue(val, fieldType)
+		if coerceErr != nil {
+			// The conversion error quotes the value, which mustn't end up in the message.
+			if err = conf.valueErrorPayload.addDecodeError(msg, newDecodeError("type", path,
+				fmt.Errorf("Cannot convert %s to %s: invalid %s", path, fieldType, schemaTypeOf(val)))); err != nil {
+				return
+			}
+			continue
 		}
+		dottedSet(rawMap, path, coerced)
 	}
 
-	if jd.config.Flatten {
-		rawMap = jd.flattenJSON(rawMap)
-		if jd.config.FlattenPrefix != "" && len(rawMap) > 0 {
-			rawMap = map[string]interface{}{jd.config.FlattenPrefix: rawMap}
+	if conf.schema != nil {
+		var dropped int
+		if dropped, err = conf.validateSchema(rawMap, msg); err != nil {
+			return
 		}
+		tolerated += dropped
 	}
 
-	for to, val := range moveMap {
-		err = dottedSet(rawMap, to, val)
-		if err != nil {
-			addDecodeError(msg, err)
+	if conf.redactor.enabled() {
+		conf.redactor.redactMap(rawMap)
+	}
+
+	var moved []movedValue
+	for _, rule := range conf.pathRules {
+		// Kept values only need taking out to shield them from flattening or strict keeping.
+		if rule.keep && !conf.Flatten && !conf.StrictKeepFields {
+			continue
+		}
+		moved = append(moved, rule.extract(rawMap)...)
+	}
+
+	if conf.StrictKeepFields {
+		var dropped int
+		rawMap, dropped = conf.headerFieldsOnly(rawMap)
+		if conf.DroppedFieldsCountField != "" {
+			var field *message.Field
+			if field, err = message.NewField(conf.DroppedFieldsCountField, int64(dropped), "count"); err != nil {
+				return tolerated, err
+			}
+			msg.AddField(field)
+		}
+		if err = conf.replacePayload(msg, rawMap, moved); err != nil {
+			return
+		}
+	}
+
+	if conf.Flatten {
+		rawMap = conf.flattenJSON(rawMap)
+		if conf.FlattenPrefix != "" && len(rawMap) > 0 {
+			rawMap = map[string]interface{}{conf.FlattenPrefix: rawMap}
+		}
+	}
+
+	for _, m := range moved {
+		if setErr := dottedSet(rawMap, m.to, m.val); setErr != nil {
+			if err = conf.valueErrorPayload.addDecodeError(msg, newDecodeError("path", m.to, setErr)); err != nil {
+				return
+			}
 		}
 	}
 
 	for key, val := range rawMap {
 		var field *message.Field
-		switch val.(type) {
+		switch t := val.(type) {
 		case nil:
 			// message.NewField crashes if you give it a nil value.
 			field, err = message.NewField(key, []byte("null"), "json")
 		case map[string]interface{}, []interface{}:
 			enc, _ := json.Marshal(val)
 			field, err = message.NewField(key, enc, "json")
+		case json.RawMessage:
+			field, err = message.NewField(key, []byte(t), "json")
+		case json.Number:
+			if n, intErr := t.Int64(); intErr == nil && key == conf.TimestampField {
+				// Keep integer timestamps exact; nanoseconds don't fit in a float64.
+				field, err = message.NewField(key, n, conf.representation(key))
+				break
+			}
+			f, _ := t.Float64()
+			field, err = message.NewField(key, f, conf.representation(key))
 		default:
-			field, err = message.NewField(key, val, "")
+			field, err = message.NewField(key, val, conf.representation(key))
 		}
 
 		if err != nil {
-			return err
+			return tolerated, err
 		}
 
-		if fieldFn, ok := jd.config.fieldMap[key]; ok {
+		if fieldFn, ok := conf.fieldMap[key]; ok {
 			err = fieldFn(msg, field)
 			if err != nil {
-				return err
+				return tolerated, err
 			}
 			continue
 		}
 		msg.AddField(field)
 	}
+	return tolerated, nil
+}
+
+// replacePayload re-encodes doc, with the moved values put back in their new places, as the
+// payload of msg in place of the original JSON.
+func (conf *JSONDecoderConfig) replacePayload(msg *message.Message, doc map[string]interface{}, moved []movedValue) error {
+	enc, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if len(moved) > 0 {
+		// Work on a copy, so that setting the moved values doesn't change doc.
+		copied := make(map[string]interface{})
+		if err = unmarshalJSON(string(enc), &copied); err != nil {
+			return err
+		}
+		for _, m := range moved {
+			dottedSet(copied, m.to, m.val)
+		}
+		if enc, err = json.Marshal(copied); err != nil {
+			return err
+		}
+	}
+	conf.errorPayload.replacePayload(msg, string(enc))
 	return nil
 }
 
-func dottedSet(m map[string]interface{}, path string, val interface{}) error {
-	keys := strings.Split(path, ".")
-	var key string
-	var ok bool
-	for len(keys) > 1 {
-		key = keys[0]
-		keys = keys[1:]
-		subM, exists := m[key]
-		if !exists {
-			subM = map[string]interface{}{}
-			m[key] = subM
+// redactPayloadJSON replaces the payload of msg with a redacted copy of rawMap.
+func (conf *JSONDecoderConfig) redactPayloadJSON(rawMap map[string]interface{}, msg *message.Message) error {
+	enc, err := json.Marshal(rawMap)
+	if err != nil {
+		return err
+	}
+	doc := make(map[string]interface{})
+	if err = unmarshalJSON(string(enc), &doc); err != nil {
+		return err
+	}
+	conf.redactor.redactMap(doc)
+	return conf.replacePayload(msg, doc, nil)
+}
+
+// buildProfiles makes a complete configuration for each profile by overlaying it on a copy of
+// the top-level one.
+func (conf *JSONDecoderConfig) buildProfiles() error {
+	conf.profiles = make(map[string]*JSONDecoderConfig, len(conf.Profiles))
+	conf.profileMatchers = nil
+	if _, ok := conf.Profiles[conf.DefaultProfile]; conf.DefaultProfile != "" && !ok {
+		return fmt.Errorf("Unknown default_profile: %s", conf.DefaultProfile)
+	}
+
+	names := make([]string, 0, len(conf.Profiles))
+	for name := range conf.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := conf.Profiles[name]
+		if p == nil {
+			// An empty table is a profile that uses the top-level settings as they are.
+			p = &JSONDecoderProfile{}
+		}
+		profile, err := conf.applyProfile(p)
+		if err != nil {
+			return fmt.Errorf("Profile %s: %s", name, err.Error())
 		}
-		if m, ok = subM.(map[string]interface{}); !ok {
-			return fmt.Errorf("Key does not refer to an object: %s", key)
+		conf.profiles[name] = profile
+
+		if p.MessageMatcher != "" {
+			matcher, err := message.CreateMatcherSpecification(p.MessageMatcher)
+			if err != nil {
+				return fmt.Errorf("Profile %s: invalid message_matcher: %s", name, err.Error())
+			}
+			conf.profileMatchers = append(conf.profileMatchers, profileMatcher{name, matcher})
 		}
 	}
-	m[keys[0]] = val
 	return nil
 }
 
-func dottedRemove(m map[string]interface{}, path string) (interface{}, bool) {
-	keys := strings.SplitN(path, ".", 2)
-	val, exists := m[keys[0]]
-	if !exists {
-		return nil, false
+func (conf *JSONDecoderConfig) applyProfile(p *JSONDecoderProfile) (*JSONDecoderConfig, error) {
+	profile := *conf
+	profile.Profiles = nil
+	profile.profiles = nil
+	profile.profileMatchers = nil
+
+	for _, s := range []struct {
+		dst *string
+		src string
+	}{
+		{&profile.TimestampField, p.TimestampField},
+		{&profile.UUIDField, p.UUIDField},
+		{&profile.TypeField, p.TypeField},
+		{&profile.LoggerField, p.LoggerField},
+		{&profile.EnvVersionField, p.EnvVersionField},
+		{&profile.HostnameField, p.HostnameField},
+		{&profile.SeverityField, p.SeverityField},
+		{&profile.PIDField, p.PIDField},
+	} {
+		if s.src != "" {
+			*s.dst = s.src
+		}
+	}
+	if p.Flatten != nil {
+		profile.Flatten = *p.Flatten
+	}
+	if p.FlattenPrefix != nil {
+		profile.FlattenPrefix = *p.FlattenPrefix
+	}
+	if p.FlattenToStrings != nil {
+		profile.FlattenToStrings = *p.FlattenToStrings
+	}
+	if p.MoveFields != nil {
+		profile.MoveFields = p.MoveFields
+	}
+	if p.KeepFields != nil {
+		profile.KeepFields = p.KeepFields
+	}
+	if p.RemoveFields != nil {
+		profile.RemoveFields = p.RemoveFields
+	}
+	if p.FieldTypes != nil {
+		profile.FieldTypes = p.FieldTypes
+	}
+
+	for path, fieldType := range profile.FieldTypes {
+		if !fieldTypes[fieldType] {
+			return nil, fmt.Errorf("Unknown field type for %s: %s", path, fieldType)
+		}
+	}
+	profile.buildFieldMap()
+	var err error
+	profile.pathRules, err = buildPathRules(profile.MoveFields, profile.KeepFields, profile.RemoveFields)
+	return &profile, err
+}
+
+// profileFor returns the configuration to decode rawMap with.
+func (conf *JSONDecoderConfig) profileFor(rawMap map[string]interface{}, msg *message.Message) *JSONDecoderConfig {
+	if len(conf.profiles) == 0 {
+		return conf
+	}
+	if conf.ProfileField != "" {
+		if val, exists := dottedGet(rawMap, conf.ProfileField); exists {
+			if profile, ok := conf.profiles[fmt.Sprint(val)]; ok {
+				return profile
+			}
+		}
+	}
+	for _, m := range conf.profileMatchers {
+		if m.matcher.Match(msg) {
+			return conf.profiles[m.name]
+		}
+	}
+	if profile, ok := conf.profiles[conf.DefaultProfile]; ok {
+		return profile
+	}
+	return conf
+}
+
+func (conf *JSONDecoderConfig) buildSchema() (err error) {
+	conf.schema = nil
+	switch {
+	case conf.SchemaFile != "" && len(conf.SchemaTypes) > 0:
+		return errors.New("Only one of schema_file and schema_types can be given")
+	case conf.SchemaFile != "":
+		conf.schema, err = loadSchemaFile(conf.SchemaFile)
+	case len(conf.SchemaTypes) > 0:
+		conf.schema, err = typeSpecSchema(conf.SchemaTypes)
+	}
+	return
+}
+
+// validateSchema records the schema violations in rawMap as decode errors, dropping the offending
+// values in strict mode. It returns the number of values dropped.
+func (conf *JSONDecoderConfig) validateSchema(rawMap map[string]interface{}, msg *message.Message) (int, error) {
+	var drop []string
+	for _, v := range conf.schema.validate(rawMap, "") {
+		if err := conf.valueErrorPayload.addDecodeError(msg, newDecodeError("schema", v.path, v.err)); err != nil {
+			return 0, err
+		}
+		if conf.SchemaStrict && !v.missing && v.path != "" {
+			drop = append(drop, v.path)
+		}
+	}
+	// Work backwards so that removing array elements doesn't shift the later paths. Values inside
+	// raw JSON can't be removed, so they still fail the message.
+	dropped := 0
+	for i := len(drop) - 1; i >= 0; i-- {
+		if _, removed := dottedRemove(rawMap, drop[i]); removed {
+			dropped++
+		}
 	}
+	return dropped, nil
+}
 
-	// At the last key, remove and return the value.
-	if len(keys) == 1 {
-		delete(m, keys[0])
-		return val, true
+// headerFieldsOnly returns a map holding only the values that will be extracted into message
+// headers, along with the number of other values that were left behind.
+func (conf *JSONDecoderConfig) headerFieldsOnly(rawMap map[string]interface{}) (map[string]interface{}, int) {
+	kept := make(map[string]interface{}, len(conf.fieldMap))
+	for name := range conf.fieldMap {
+		if val, exists := rawMap[name]; exists {
+			kept[name] = val
+			delete(rawMap, name)
+		} else if val, exists := dottedRemove(rawMap, name); exists {
+			dottedSet(kept, name, val)
+		}
 	}
+	dropped := 0
+	for _, val := range rawMap {
+		dropped += countLeaves(val)
+	}
+	return kept, dropped
+}
 
-	subTable, ok := val.(map[string]interface{})
-	if !ok {
-		return nil, false
+// countLeaves counts the scalar values, empty objects and empty arrays below val.
+func countLeaves(val interface{}) int {
+	count := 0
+	switch t := val.(type) {
+	case map[string]interface{}:
+		for _, v := range t {
+			count += countLeaves(v)
+		}
+	case []interface{}:
+		for _, v := range t {
+			count += countLeaves(v)
+		}
+	default:
+		return 1
+	}
+	if count == 0 {
+		return 1
 	}
+	return count
+}
 
-	val, exists = dottedRemove(subTable, keys[1])
-	if !exists {
-		return nil, false
+// unmarshalJSON decodes a single JSON document, keeping numbers as json.Number so that no
+// precision is lost before field types are applied.
+func unmarshalJSON(data string, v interface{}) error {
+	r := strings.NewReader(data)
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &decodeError{"syntax", int64(len(data)), "", errors.New("unexpected end of JSON input")}
+		}
+		return err
 	}
-	if len(subTable) == 0 {
-		delete(m, keys[0])
+
+	rest := new(bytes.Buffer)
+	io.Copy(rest, dec.Buffered())
+	io.Copy(rest, r)
+	if trailing := bytes.TrimLeft(rest.Bytes(), " \t\r\n"); len(trailing) > 0 {
+		offset := int64(len(data) - len(trailing))
+		return &decodeError{"syntax", offset, "", fmt.Errorf("invalid character %q after top-level value", trailing[0])}
 	}
-	return val, true
+	return nil
 }
 
-func (jd *JSONDecoder) flattenJSON(j map[string]interface{}) map[string]interface{} {
+func (conf *JSONDecoderConfig) flattenJSON(j map[string]interface{}) map[string]interface{} {
 	flat := make(map[string]interface{}, len(j))
-	jd.doFlattenJSON(j, flat, "")
+	conf.doFlattenJSON(j, flat, "")
 	return flat
 }
 
-func (jd *JSONDecoder) doFlattenJSON(j, flat map[string]interface{}, prefix string) {
+func (conf *JSONDecoderConfig) doFlattenJSON(j, flat map[string]interface{}, prefix string) {
 	for key, val := range j {
 		pkey := prefix + key
 		switch t := val.(type) {
 		case []interface{}:
-			if jd.config.FlattenToStrings {
+			if conf.FlattenToStrings {
 				val = iSliceToStrings(t)
 			}
 		case map[string]interface{}:
-			jd.doFlattenJSON(t, flat, pkey+".")
+			conf.doFlattenJSON(t, flat, pkey+".")
 			continue
 		default:
-			if jd.config.FlattenToStrings {
+			if conf.FlattenToStrings {
 				val = iToString(val)
 			}
 		}
@@ -241,6 +760,150 @@ func iToString(val interface{}) string {
 	return string(enc)
 }
 
+func (conf *JSONDecoderConfig) buildRepresentations() error {
+	conf.repGlobs = nil
+	globs := make([]string, 0, len(conf.FieldRepresentations))
+	for name := range conf.FieldRepresentations {
+		if isGlob(name) {
+			globs = append(globs, name)
+		}
+	}
+	sort.Strings(globs)
+	for _, glob := range globs {
+		re, err := globToRegexp(glob)
+		if err != nil {
+			return fmt.Errorf("Invalid field_representations glob %s: %s", glob, err.Error())
+		}
+		conf.repGlobs = append(conf.repGlobs, representationGlob{re, conf.FieldRepresentations[glob]})
+	}
+	return nil
+}
+
+// representation returns the configured representation for a field name, preferring exact names
+// over globs.
+func (conf *JSONDecoderConfig) representation(name string) string {
+	if rep, ok := conf.FieldRepresentations[name]; ok && !isGlob(name) {
+		return rep
+	}
+	for _, g := range conf.repGlobs {
+		if g.re.MatchString(name) {
+			return g.representation
+		}
+	}
+	return ""
+}
+
+var fieldTypes = map[string]bool{
+	"int":       true,
+	"double":    true,
+	"bool":      true,
+	"string":    true,
+	"bytes":     true,
+	"json":      true,
+	"timestamp": true,
+}
+
+// coerceValue converts a decoded JSON value into the Go type that message.NewField maps to the
+// requested field type. Values of type "json" become a json.RawMessage.
+func (conf *JSONDecoderConfig) coerceValue(val interface{}, fieldType string) (interface{}, error) {
+	if fieldType == "json" {
+		enc, err := json.Marshal(val)
+		return json.RawMessage(enc), err
+	}
+	if val == nil {
+		return nil, errors.New("value is null")
+	}
+
+	switch fieldType {
+	case "int":
+		switch t := val.(type) {
+		case json.Number:
+			if i, err := t.Int64(); err == nil {
+				return i, nil
+			}
+			f, err := t.Float64()
+			if err != nil || f != float64(int64(f)) {
+				return nil, fmt.Errorf("not an integer: %s", t)
+			}
+			return int64(f), nil
+		case string:
+			return strconv.ParseInt(t, 10, 64)
+		case bool:
+			if t {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	case "double":
+		switch t := val.(type) {
+		case json.Number:
+			return t.Float64()
+		case string:
+			return strconv.ParseFloat(t, 64)
+		case bool:
+			if t {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		}
+	case "bool":
+		switch t := val.(type) {
+		case bool:
+			return t, nil
+		case json.Number:
+			f, err := t.Float64()
+			return f != 0, err
+		case string:
+			return strconv.ParseBool(t)
+		}
+	case "string", "bytes":
+		var str string
+		switch t := val.(type) {
+		case string:
+			str = t
+		case json.Number:
+			str = t.String()
+		case bool:
+			str = strconv.FormatBool(t)
+		default:
+			enc, err := json.Marshal(t)
+			if err != nil {
+				return nil, err
+			}
+			str = string(enc)
+		}
+		if fieldType == "bytes" {
+			return []byte(str), nil
+		}
+		return str, nil
+	case "timestamp":
+		var (
+			timestamp time.Time
+			err       error
+		)
+		switch t := val.(type) {
+		case json.Number:
+			if n, intErr := t.Int64(); intErr == nil {
+				timestamp = conf.epochTimeInt(n)
+			} else {
+				var f float64
+				if f, err = t.Float64(); err == nil {
+					timestamp = conf.epochTime(f)
+				}
+			}
+		case string:
+			timestamp, err = conf.parseTimestampString(t)
+		default:
+			return nil, fmt.Errorf("not a timestamp: %v", t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return timestamp.UnixNano(), nil
+	}
+	return nil, fmt.Errorf("unexpected value: %v", val)
+}
+
 func (conf *JSONDecoderConfig) buildFieldMap() {
 	conf.fieldMap = make(map[string]fieldDecoder)
 	for _, f := range []struct {
@@ -262,6 +925,93 @@ func (conf *JSONDecoderConfig) buildFieldMap() {
 	}
 }
 
+// epochUnits maps timestamp_unit values to nanosecond multipliers.
+var epochUnits = map[string]int64{
+	"s":  1e9,
+	"ms": 1e6,
+	"us": 1e3,
+	"ns": 1,
+}
+
+func (conf *JSONDecoderConfig) buildTimestampParsing() error {
+	switch conf.TimestampUnit {
+	case "":
+		conf.TimestampUnit = "auto"
+	case "auto":
+	default:
+		if _, ok := epochUnits[conf.TimestampUnit]; !ok {
+			return fmt.Errorf("Unknown timestamp_unit: %s", conf.TimestampUnit)
+		}
+	}
+
+	conf.timestampLocation = time.UTC
+	if conf.TimestampTimezone != "" {
+		loc, err := time.LoadLocation(conf.TimestampTimezone)
+		if err != nil {
+			return fmt.Errorf("Invalid timestamp_timezone: %s", err.Error())
+		}
+		conf.timestampLocation = loc
+	}
+
+	conf.timestampLayouts = nil
+	for _, format := range conf.TimestampFormats {
+		if strings.Contains(format, "%") {
+			var err error
+			if format, err = strftimeLayout(format); err != nil {
+				return err
+			}
+		}
+		conf.timestampLayouts = append(conf.timestampLayouts, format)
+	}
+	if len(conf.timestampLayouts) == 0 {
+		conf.timestampLayouts = []string{time.RFC3339}
+	}
+	return nil
+}
+
+// epochUnit guesses the unit of an epoch timestamp from its magnitude. Seconds stay below 1e11
+// until the year 5138, so each unit gets its own three orders of magnitude from there.
+func epochUnit(v float64) string {
+	if v < 0 {
+		v = -v
+	}
+	switch {
+	case v < 1e11:
+		return "s"
+	case v < 1e14:
+		return "ms"
+	case v < 1e17:
+		return "us"
+	}
+	return "ns"
+}
+
+func (conf *JSONDecoderConfig) epochTime(v float64) time.Time {
+	unit := conf.TimestampUnit
+	if unit == "auto" {
+		unit = epochUnit(v)
+	}
+	return time.Unix(0, int64(v*float64(epochUnits[unit])))
+}
+
+// epochTimeInt is epochTime for integers, which keeps nanosecond timestamps exact.
+func (conf *JSONDecoderConfig) epochTimeInt(n int64) time.Time {
+	unit := conf.TimestampUnit
+	if unit == "auto" {
+		unit = epochUnit(float64(n))
+	}
+	return time.Unix(0, n*epochUnits[unit])
+}
+
+func (conf *JSONDecoderConfig) parseTimestampString(s string) (timestamp time.Time, err error) {
+	for _, layout := range conf.timestampLayouts {
+		if timestamp, err = message.ForgivingTimeParse(layout, s, conf.timestampLocation); err == nil {
+			return
+		}
+	}
+	return
+}
+
 func (conf *JSONDecoderConfig) decodeTimestamp(msg *message.Message, field *message.Field) error {
 	var (
 		timestamp time.Time
@@ -269,23 +1019,23 @@ func (conf *JSONDecoderConfig) decodeTimestamp(msg *message.Message, field *mess
 	)
 	switch *(field.ValueType) {
 	case message.Field_STRING:
-		timestamp, err = message.ForgivingTimeParse(time.RFC3339, field.GetValueString()[0], time.UTC)
+		timestamp, err = conf.parseTimestampString(field.GetValueString()[0])
 	case message.Field_DOUBLE:
-		v := field.GetValueDouble()[0]
-
-		// Anything with < 14 digits is *probably* epoch seconds rather than microseconds.
-		if v < 10000000000000 {
-			v *= 1000000000
+		timestamp = conf.epochTime(field.GetValueDouble()[0])
+	case message.Field_INTEGER:
+		if conf.FieldTypes[conf.TimestampField] == "timestamp" {
+			// Already converted to nanoseconds by field_types.
+			timestamp = time.Unix(0, field.GetValueInteger()[0])
+		} else {
+			timestamp = conf.epochTimeInt(field.GetValueInteger()[0])
 		}
-
-		// time.Unix takes seconds and microseconds, so convert microseconds to those.
-		timestamp = time.Unix(int64(v)/1000000000, int64(v)%1000000000)
 	default:
 		return nil
 	}
 
 	if err != nil {
-		return addDecodeError(msg, fmt.Errorf("Invalid timestamp: %s", err.Error()))
+		return conf.valueErrorPayload.addDecodeError(msg, newDecodeError("timestamp", conf.TimestampField,
+			fmt.Errorf("Invalid timestamp: %s is not in a known format", conf.TimestampField)))
 	}
 	msg.SetTimestamp(timestamp.UnixNano())
 	return nil
@@ -299,37 +1049,22 @@ func (conf *JSONDecoderConfig) decodeUUID(msg *message.Message, field *message.F
 	}
 
 	if u == nil {
-		return addDecodeError(msg, fmt.Errorf("Not a valid UUID: %s", field.String()))
+		return conf.valueErrorPayload.addDecodeError(msg, newDecodeError("uuid", conf.UUIDField,
+			fmt.Errorf("Not a valid UUID at %s", conf.UUIDField)))
 	}
 	msg.SetUuid(u)
 	return nil
 }
 
-var severityMap = []struct {
-	name     string
-	severity int32
-}{
-	{"alert", 1},
-	{"crit", 2},
-	{"err", 3},
-	{"warn", 4},
-	{"notice", 5},
-	{"info", 6},
-	{"debug", 7},
-	{"emerg", 0},
-}
-
 func (conf *JSONDecoderConfig) decodeSeverity(msg *message.Message, field *message.Field) error {
 	switch *(field.ValueType) {
 	case message.Field_DOUBLE:
 		msg.SetSeverity(int32(field.GetValueDouble()[0]))
+	case message.Field_INTEGER:
+		msg.SetSeverity(int32(field.GetValueInteger()[0]))
 	case message.Field_STRING:
-		level := strings.ToLower(field.GetValueString()[0])
-		for _, s := range severityMap {
-			if strings.HasPrefix(level, s.name) || strings.HasPrefix(s.name, level) {
-				msg.SetSeverity(s.severity)
-				break
-			}
+		if severity, ok := conf.severities.severity(field.GetValueString()[0]); ok {
+			msg.SetSeverity(severity)
 		}
 	}
 	return nil
@@ -349,11 +1084,15 @@ func (conf *JSONDecoderConfig) decodeStringField(setter func(*message.Message, s
 
 func (conf *JSONDecoderConfig) decodeIntField(setter func(*message.Message, int32)) fieldDecoder {
 	return func(msg *message.Message, field *message.Field) error {
-		if *field.ValueType == message.Field_DOUBLE {
-			v := field.GetValueDouble()[0]
-			if v != 0 {
-				setter(msg, int32(v))
-			}
+		var v int32
+		switch *field.ValueType {
+		case message.Field_DOUBLE:
+			v = int32(field.GetValueDouble()[0])
+		case message.Field_INTEGER:
+			v = int32(field.GetValueInteger()[0])
+		}
+		if v != 0 {
+			setter(msg, v)
 		}
 		return nil
 	}
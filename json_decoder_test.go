@@ -1,12 +1,20 @@
 package hekalocal_test
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/OwnLocal/heka-plugins"
 	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/onsi/gomega"
 )
 
@@ -46,7 +54,13 @@ func TestDecode(t *testing.T) {
                 }`)), "json"),
 			},
 		},
-		{`This isn't valid JSON`, fields{newField("decode_error", "invalid character 'T' looking for beginning of value", ""), newField("payload", "This isn't valid JSON", "")}},
+		{`This isn't valid JSON`, fields{
+			newField("decode_error", "invalid character 'T' looking for beginning of value", ""),
+			newField("decode_error.kind", "syntax", ""),
+			newField("decode_error.offset", int64(1), ""),
+			newField("decode_error.path", "", ""),
+			newField("payload", "This isn't valid JSON", ""),
+		}},
 	}
 
 	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{})
@@ -81,6 +95,91 @@ func TestDecodeTimestamp(t *testing.T) {
 	}
 }
 
+func TestDecodeTimestampUnits(t *testing.T) {
+	want := time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano()
+	cases := []struct {
+		unit  string
+		in    string
+		nanos int64
+	}{
+		{"", `{"@timestamp": 1444471810}`, 0},
+		{"", `{"@timestamp": 1444471810000}`, 0},
+		{"", `{"@timestamp": 1444471810000000}`, 0},
+		{"", `{"@timestamp": 1444471810000000000}`, 0},
+		{"auto", `{"@timestamp": 1444471810000}`, 0},
+		{"s", `{"@timestamp": 1444471810}`, 0},
+		{"ms", `{"@timestamp": 1444471810000}`, 0},
+		{"us", `{"@timestamp": 1444471810000000}`, 0},
+		{"ns", `{"@timestamp": 1444471810000000000}`, 0},
+		{"ns", `{"@timestamp": 1444471810000000001}`, 1},
+		{"", `{"@timestamp": 1444471810000000001}`, 1},
+	}
+
+	for _, c := range cases {
+		dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{TimestampField: "@timestamp", TimestampUnit: c.unit})
+		dt.testDecode(c.in, nil)
+		Expect(dt.pack.Message.GetTimestamp()).To(Equal(want + c.nanos))
+	}
+}
+
+func TestDecodeTimestampFieldType(t *testing.T) {
+	want := time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano()
+	for _, unit := range []string{"", "s", "ms"} {
+		dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+			TimestampField: "ts",
+			TimestampUnit:  unit,
+			FieldTypes:     map[string]string{"ts": "timestamp"},
+		})
+		in := `{"ts": 1444471810}`
+		if unit == "ms" {
+			in = `{"ts": 1444471810000}`
+		}
+		dt.testDecode(in, nil)
+		Expect(dt.pack.Message.GetTimestamp()).To(Equal(want))
+	}
+}
+
+func TestDecodeTimestampFormats(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		TimestampField:    "@timestamp",
+		TimestampFormats:  []string{"02/Jan/2006:15:04:05 -0700", "%Y-%m-%d %H:%M:%S", "%a %e %b %y %I:%M:%S.%f %p"},
+		TimestampTimezone: "America/Chicago",
+	})
+
+	cases := []struct {
+		in            string
+		wantTimestamp int64
+	}{
+		{`{"@timestamp": "10/Oct/2015:10:10:10 +0000"}`, time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano()},
+		{`{"@timestamp": "2015-10-10 05:10:10"}`, time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano()},
+		{`{"@timestamp": "2015-10-10T10:10:10Z"}`, time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano()},
+		{`{"@timestamp": "Mon  5 Oct 15 01:10:10.250000 PM"}`, time.Date(2015, 10, 5, 18, 10, 10, 250000000, time.UTC).UnixNano()},
+	}
+
+	for _, c := range cases {
+		dt.testDecode(c.in, nil)
+		Expect(dt.pack.Message.GetTimestamp()).To(Equal(c.wantTimestamp))
+	}
+
+	dt.testDecodeError(`{"@timestamp": "10/10/2015"}`, ContainSubstring("Invalid timestamp: "))
+}
+
+func TestDecodeTimestampBadConfig(t *testing.T) {
+	RegisterTestingT(t)
+	for _, conf := range []*hekalocal.JSONDecoderConfig{
+		{TimestampUnit: "minutes"},
+		{TimestampTimezone: "Not/AZone"},
+		{TimestampFormats: []string{"%j"}},
+		{TimestampFormats: []string{"%s"}},
+		{TimestampFormats: []string{"%H:%M:%S.%f%"}},
+		{TimestampFormats: []string{"%Y%f"}},
+		{TimestampFormats: []string{"day 1 of %Y"}},
+		{TimestampFormats: []string{"%Y Mon"}},
+	} {
+		Expect((&hekalocal.JSONDecoder{}).Init(conf)).To(HaveOccurred())
+	}
+}
+
 func TestDecodeBadTimestamp(t *testing.T) {
 	cases := []interface{}{
 		"2015-10T10:10:10Z",
@@ -94,6 +193,114 @@ func TestDecodeBadTimestamp(t *testing.T) {
 	}
 }
 
+func TestDecodeErrorDetails(t *testing.T) {
+	cases := []struct {
+		in          string
+		wantErrors  []string
+		wantKinds   []string
+		wantOffsets []int64
+		wantPaths   []string
+	}{
+		{`[1, 2]`, []string{"json: cannot unmarshal array into Go value of type map[string]interface {}"}, []string{"type"}, []int64{1}, []string{""}},
+		{`{"a": 1} {"b": 2}`, []string{"invalid character '{' after top-level value"}, []string{"syntax"}, []int64{9}, []string{""}},
+		{`{"a": `, []string{"unexpected end of JSON input"}, []string{"syntax"}, []int64{6}, []string{""}},
+		{`   `, []string{"unexpected end of JSON input"}, []string{"syntax"}, []int64{3}, []string{""}},
+		{`{"n": "x", "ts": "never", "o": 1, "o2": {"x": 1}}`,
+			[]string{"Cannot convert n to int: invalid string", "Key does not refer to an object: o", "Invalid timestamp: "},
+			[]string{"type", "path", "timestamp"},
+			[]int64{-1, -1, -1},
+			[]string{"n", "o.x", "ts"},
+		},
+	}
+
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		TimestampField: "ts",
+		FieldTypes:     map[string]string{"n": "int"},
+		MoveFields:     map[string]string{"o2.x": "o.x"},
+	})
+
+	for _, c := range cases {
+		dt.pack = &pipeline.PipelinePack{}
+		dt.pack.Message = &message.Message{Payload: &c.in}
+		packs, err := dt.decoder.Decode(dt.pack)
+		Expect(err).NotTo(HaveOccurred())
+		msg := packs[0].Message
+		errs := msg.FindFirstField("decode_error").GetValueString()
+		Expect(errs).To(HaveLen(len(c.wantErrors)))
+		for i, e := range c.wantErrors {
+			Expect(errs[i]).To(HavePrefix(e))
+		}
+		Expect(msg.FindFirstField("decode_error.kind").GetValueString()).To(Equal(c.wantKinds))
+		Expect(msg.FindFirstField("decode_error.offset").GetValueInteger()).To(Equal(c.wantOffsets))
+		Expect(msg.FindFirstField("decode_error.path").GetValueString()).To(Equal(c.wantPaths))
+		Expect(msg.FindAllFields("payload")).To(HaveLen(1))
+		Expect(msg.FindFirstField("payload").GetValueString()).To(Equal([]string{c.in}))
+	}
+}
+
+func TestDecodeErrorPayload(t *testing.T) {
+	cases := []struct {
+		mode        string
+		length      int
+		wantPayload []string
+	}{
+		{"", 0, []string{"not json at all"}},
+		{"keep", 0, []string{"not json at all"}},
+		{"truncate", 3, []string{"not"}},
+		{"truncate", 0, []string{"not json at all"}},
+		{"drop", 0, nil},
+	}
+
+	for _, c := range cases {
+		dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+			DecodeErrorPayload:       c.mode,
+			DecodeErrorPayloadLength: c.length,
+		})
+		payload := "not json at all"
+		dt.pack = &pipeline.PipelinePack{}
+		dt.pack.Message = &message.Message{Payload: &payload}
+		packs, err := dt.decoder.Decode(dt.pack)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packs[0].Message.FindFirstField("decode_error")).NotTo(BeNil())
+		Expect(packs[0].Message.FindFirstField("payload").GetValueString()).To(Equal(c.wantPayload))
+	}
+
+	// Truncation doesn't split a multi-byte character.
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		DecodeErrorPayload:       "truncate",
+		DecodeErrorPayloadLength: 5,
+	})
+	payload := "caf\u00e9 \u00e9t\u00e9"
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.FindFirstField("payload").GetValueString()).To(Equal([]string{"caf\u00e9"}))
+
+	err = (&hekalocal.JSONDecoder{}).Init(&hekalocal.JSONDecoderConfig{DecodeErrorPayload: "shred"})
+	Expect(err).To(HaveOccurred())
+}
+
+func TestDecodeErrorsHideValues(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		TimestampField:     "ts",
+		UUIDField:          "id",
+		FieldTypes:         map[string]string{"email": "int"},
+		KeepFields:         []string{"n"},
+		StrictKeepFields:   true,
+		DecodeErrorPayload: "drop",
+	})
+	payload := `{"email": "hunter2@example.com", "ts": "hunter2", "id": "hunter2", "n": 1}`
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	msg := packs[0].Message
+	errs := msg.FindFirstField("decode_error").GetValueString()
+	Expect(errs).To(HaveLen(3))
+	for _, e := range errs {
+		Expect(e).NotTo(ContainSubstring("hunter2"))
+	}
+	Expect(msg.FindFirstField("decode_error.path").GetValueString()).To(ConsistOf("email", "ts", "id"))
+	Expect(msg.GetPayload()).NotTo(ContainSubstring("example.com"))
+}
+
 func TestDecodeUUID(t *testing.T) {
 	cases := []struct {
 		in         string
@@ -140,8 +347,14 @@ func TestDecodeSeverity(t *testing.T) {
 		{"notice", 5}, {"NOTICE", 5}, {"N", 5},
 		{"info", 6}, {"INFORMATION", 6}, {"I", 6},
 		{"debug", 7}, {"DEBUG", 7}, {"D", 7},
+		{"fatal", 2}, {"panic", 0}, {"trace", 7}, {"Warnings", 4}, {"5", 5},
+		{"warn", 4}, {"Crit", 2}, {"Cri", 2}, {"inf", 6}, {"emer", 0},
 		{42, 42},
 		{"Not a valid thing", 7},
+		// "em" abbreviates both emerg and emergency, "er" both err and error.
+		{"em", 0}, {"Er", 3},
+		// "cr" could be crit or critical, but "p" is only panic.
+		{"cr", 2}, {"p", 0},
 	}
 
 	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{SeverityField: "severity"})
@@ -151,6 +364,31 @@ func TestDecodeSeverity(t *testing.T) {
 	}
 }
 
+func TestDecodeSeverityNames(t *testing.T) {
+	cases := []struct {
+		in        string
+		wantLevel int32
+	}{
+		{"Verbose", 7},
+		{"trace", 6},
+		{"SEVERE", 2},
+		{"err", 3},
+		// Custom names are matched as prefixes too, ahead of shorter built in ones.
+		{"Verbosely", 7},
+		{"errata: none", 6},
+		{"errors", 3},
+	}
+
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		SeverityField: "severity",
+		SeverityNames: map[string]int32{"verbose": 7, "Trace": 6, "severe": 2, "errata": 6},
+	})
+	for _, c := range cases {
+		dt.testDecode(fmt.Sprintf(`{"severity": %q}`, c.in), nil)
+		Expect(dt.pack.Message.GetSeverity()).To(Equal(c.wantLevel))
+	}
+}
+
 func TestDecodeStringFields(t *testing.T) {
 	conf := hekalocal.JSONDecoderConfig{}
 
@@ -241,6 +479,36 @@ func TestHashUUID(t *testing.T) {
 	}
 }
 
+func TestHashUUIDFields(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		HashUUID:       true,
+		HashFields:     []string{"id"},
+		HashAlgorithm:  "sha256",
+		HashNamespace:  "orders",
+		TimestampField: "timestamp",
+	})
+
+	dt.testDecode(`{"timestamp": "2015-10-10T10:10:10Z", "id": 1, "ingested": "10:10:11"}`, fields{newField("id", 1.0, ""), newField("ingested", "10:10:11", "")})
+	first := dt.pack.Message.GetUuidString()
+	dt.testDecode(`{"timestamp": "2015-10-10T10:10:10Z", "id": 1, "ingested": "10:10:15"}`, fields{newField("id", 1.0, ""), newField("ingested", "10:10:15", "")})
+	Expect(dt.pack.Message.GetUuidString()).To(Equal(first))
+	dt.testDecode(`{"timestamp": "2015-10-10T10:10:10Z", "id": 2, "ingested": "10:10:11"}`, fields{newField("id", 2.0, ""), newField("ingested", "10:10:11", "")})
+	Expect(dt.pack.Message.GetUuidString()).NotTo(Equal(first))
+
+	dt.testDecodeError(`{"timestamp": "2015-10-10T10:10:10Z"}`, Equal("Nothing to hash for the UUID"))
+}
+
+func TestHashUUIDMode(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		HashUUID:       true,
+		UUIDMode:       "v7",
+		TimestampField: "timestamp",
+	})
+
+	dt.testDecode(`{"timestamp": "2015-10-10T10:10:10Z"}`, nil)
+	Expect(dt.pack.Message.GetUuidString()).To(HavePrefix("0150513a-a7d0-7"))
+}
+
 func TestDecodeFlatten(t *testing.T) {
 	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
 		Flatten: true,
@@ -356,6 +624,58 @@ func TestMoveFields(t *testing.T) {
 	}
 }
 
+func TestMoveFieldsPatterns(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		MoveFields: map[string]string{
+			"headers.x-*":          "http.headers.$1",
+			`/^meta\.(\w+)_id$/`:   "ids.${1}",
+			"items[0].id":          "first_id",
+			"list[*]":              "",
+			"nested.**.deep_field": "deep",
+		},
+		RemoveFields: []string{"*.password", "items[1]"},
+	})
+
+	cases := []struct {
+		in         string
+		wantFields fields
+	}{
+		{`{"headers": {"x-a": "1", "x-b": "2", "host": "h"}}`, fields{
+			newField("headers", []byte(`{"host":"h"}`), "json"),
+			newField("http", []byte(`{"headers":{"a":"1","b":"2"}}`), "json"),
+		}},
+		{`{"meta": {"user_id": 1, "org_id": 2, "name": "n"}}`, fields{
+			newField("meta", []byte(`{"name":"n"}`), "json"),
+			newField("ids", []byte(`{"org":2,"user":1}`), "json"),
+		}},
+		{`{"user": {"password": "secret", "name": "n"}, "password": "top"}`, fields{
+			newField("user", []byte(`{"name":"n"}`), "json"),
+			newField("password", "top", ""),
+		}},
+		{`{"items": [{"id": 1, "n": "a"}, {"id": 2}, {"id": 3}]}`, fields{
+			newField("items", []byte(`[{"n":"a"},null,{"id":3}]`), "json"),
+			newField("first_id", 1.0, ""),
+		}},
+		{`{"list": [1, 2, 3], "other": 4}`, fields{newField("other", 4.0, "")}},
+		{`{"nested": {"a": {"b": {"deep_field": 1}}}}`, fields{newField("deep", 1.0, "")}},
+	}
+
+	for _, c := range cases {
+		dt.testDecode(c.in, c.wantFields)
+	}
+}
+
+func TestMoveFieldsBadPattern(t *testing.T) {
+	RegisterTestingT(t)
+	for _, conf := range []*hekalocal.JSONDecoderConfig{
+		{MoveFields: map[string]string{"/(/": "a"}},
+		{RemoveFields: []string{"items[x]"}},
+		{KeepFields: []string{"a..b"}},
+	} {
+		Expect((&hekalocal.JSONDecoder{}).Init(conf)).To(HaveOccurred())
+	}
+}
+
 func TestKeepFields(t *testing.T) {
 	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
 		Flatten:          true,
@@ -381,6 +701,65 @@ func TestKeepFields(t *testing.T) {
 	}
 }
 
+func TestStrictKeepFields(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		TypeField:               "type",
+		StrictKeepFields:        true,
+		DroppedFieldsCountField: "dropped_fields",
+		KeepFields:              []string{"user.id", "tags[*]"},
+		MoveFields:              map[string]string{"request.path": "path"},
+	})
+	cases := []struct {
+		in         string
+		wantType   string
+		wantFields fields
+	}{
+		{`{}`, "", fields{newField("dropped_fields", int64(0), "count")}},
+		{`{"type": "t", "user": {"id": 1, "email": "a@b.c", "ssn": "x"}}`, "t", fields{
+			newField("user", []byte(`{"id":1}`), "json"),
+			newField("dropped_fields", int64(2), "count"),
+		}},
+		{`{"request": {"path": "/", "headers": {"cookie": "c", "auth": {}}}, "tags": ["a", "b"], "pii": [1, 2]}`, "", fields{
+			newField("path", "/", ""),
+			newField("tags", []byte(`["a","b"]`), "json"),
+			newField("dropped_fields", int64(4), "count"),
+		}},
+	}
+
+	for _, c := range cases {
+		dt.testDecode(c.in, c.wantFields)
+		Expect(dt.pack.Message.GetType()).To(Equal(c.wantType))
+	}
+}
+
+func TestStrictKeepFieldsPayload(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		TimestampField:   "ts",
+		StrictKeepFields: true,
+		KeepFields:       []string{"user.id"},
+		MoveFields:       map[string]string{"request.path": "path"},
+		FieldTypes:       map[string]string{"user.id": "int"},
+	})
+
+	dt.testDecode(`{"ts": 1444471810, "user": {"id": 1, "email": "a@b.c"}, "request": {"path": "/"}}`, fields{
+		newField("user", []byte(`{"id":1}`), "json"),
+		newField("path", "/", ""),
+	})
+	Expect(dt.pack.Message.GetPayload()).To(MatchJSON(`{"ts": 1444471810, "user": {"id": 1}, "path": "/"}`))
+
+	// Decode errors don't store a copy of the original payload.
+	payload := `{"ts": "yesterday", "user": {"id": "x", "email": "a@b.c"}}`
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	msg := packs[0].Message
+	Expect(msg.FindFirstField("decode_error.path").GetValueString()).To(Equal([]string{"user.id", "ts"}))
+	Expect(msg.GetPayload()).To(MatchJSON(`{"ts": "yesterday", "user": {"id": "x"}}`))
+	Expect(msg.FindFirstField("payload")).To(BeNil())
+	for _, field := range msg.Fields {
+		Expect(field.String()).NotTo(ContainSubstring("a@b.c"))
+	}
+}
+
 func TestRemoveFields(t *testing.T) {
 	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
 		Flatten:          true,
@@ -405,3 +784,731 @@ func TestRemoveFields(t *testing.T) {
 		dt.testDecode(c.in, c.wantFields)
 	}
 }
+
+func TestRemoveFieldsArrayIndices(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		RemoveFields: []string{"items[0]", "items[2]", "items[10]", "items[1].id"},
+	})
+
+	dt.testDecode(`{"items": [0, {"id": 1, "n": 1}, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11]}`, fields{
+		newField("items", []byte(`[null,{"n":1},null,3,4,5,6,7,8,9,null,11]`), "json"),
+	})
+	dt.testDecode(`{"items": [0, {"id": 1}, 2]}`, fields{
+		newField("items", []byte(`[null,{}]`), "json"),
+	})
+}
+
+func TestKeepFieldsArrayIndices(t *testing.T) {
+	for _, conf := range []*hekalocal.JSONDecoderConfig{
+		{KeepFields: []string{"items[0]"}},
+		{KeepFields: []string{"items[0]"}, Flatten: true},
+	} {
+		dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, conf)
+		dt.testDecode(`{"items": ["a", "b"]}`, fields{newField("items", []byte(`["a","b"]`), "json")})
+	}
+}
+
+func TestMoveFieldsGlobs(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		RemoveFields: []string{"**.secret"},
+	})
+
+	dt.testDecode(`{"secret": 1, "a": {"secret": 2, "b": {"secret": 3, "c": 4}}}`, fields{
+		newField("a", []byte(`{"b":{"c":4}}`), "json"),
+	})
+}
+
+func TestDecodeSplitPayload(t *testing.T) {
+	cases := []struct {
+		in           string
+		wantPayloads []string
+		wantTypes    []string
+		wantFields   []fields
+	}{
+		{`{"type": "a", "n": 1}`, []string{`{"type": "a", "n": 1}`}, []string{"a"}, []fields{{newField("n", 1.0, "")}}},
+		{"{\"type\": \"a\", \"n\": 1}\n{\"type\": \"b\", \"n\": 2}\n",
+			[]string{`{"type": "a", "n": 1}`, `{"type": "b", "n": 2}`},
+			[]string{"a", "b"},
+			[]fields{{newField("n", 1.0, "")}, {newField("n", 2.0, "")}},
+		},
+		{`[{"type": "a", "n": 1}, {"type": "b"}, {"n": 3}]`,
+			[]string{`{"type": "a", "n": 1}`, `{"type": "b"}`, `{"n": 3}`},
+			[]string{"a", "b", "orig"},
+			[]fields{{newField("n", 1.0, "")}, nil, {newField("n", 3.0, "")}},
+		},
+		{"{\"n\": 1}\n{\"n\": oops}",
+			[]string{`{"n": 1}`, `{"n": oops}`},
+			[]string{"orig", "orig"},
+			[]fields{
+				{newField("n", 1.0, "")},
+				{
+					newField("decode_error", "invalid character 'o' looking for beginning of value", ""),
+					newField("decode_error.kind", "syntax", ""),
+					newField("decode_error.offset", int64(7), ""),
+					newField("decode_error.path", "", ""),
+					newField("payload", `{"n": oops}`, ""),
+				},
+			},
+		},
+	}
+
+	decoder := &hekalocal.JSONDecoder{}
+	decoder.SetDecoderRunner(newPackSupplier())
+	dt := newDecoderTester(t, decoder, &hekalocal.JSONDecoderConfig{TypeField: "type", SplitPayload: true})
+
+	for _, c := range cases {
+		dt.pack = &pipeline.PipelinePack{}
+		dt.pack.Message = &message.Message{Payload: &c.in}
+		dt.pack.Message.SetType("orig")
+		packs, err := dt.decoder.Decode(dt.pack)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packs).To(HaveLen(len(c.wantPayloads)))
+		Expect(packs[0]).To(BeIdenticalTo(dt.pack))
+
+		uuids := map[string]bool{}
+		for i, p := range packs {
+			sort.Sort(fields(p.Message.Fields))
+			sort.Sort(c.wantFields[i])
+			Expect(p.Message.GetPayload()).To(Equal(c.wantPayloads[i]))
+			Expect(p.Message.GetType()).To(Equal(c.wantTypes[i]))
+			if len(c.wantFields[i]) == 0 {
+				Expect(p.Message.Fields).To(BeEmpty())
+			} else {
+				Expect(p.Message.Fields).To(Equal([]*message.Field(c.wantFields[i])))
+			}
+			uuids[p.Message.GetUuidString()] = true
+		}
+		Expect(uuids).To(HaveLen(len(packs)))
+	}
+}
+
+func TestDecodeFieldTypes(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		FieldTypes: map[string]string{
+			"id":      "int",
+			"ratio":   "double",
+			"enabled": "bool",
+			"code":    "string",
+			"raw":     "bytes",
+			"blob":    "json",
+			"when":    "timestamp",
+			"o.n":     "int",
+		},
+	})
+
+	cases := []struct {
+		in         string
+		wantFields fields
+	}{
+		{`{"id": 9007199254740993}`, fields{newField("id", int64(9007199254740993), "")}},
+		{`{"id": "42"}`, fields{newField("id", int64(42), "")}},
+		{`{"id": 42.0}`, fields{newField("id", int64(42), "")}},
+		{`{"ratio": "0.5"}`, fields{newField("ratio", 0.5, "")}},
+		{`{"enabled": "true"}`, fields{newField("enabled", true, "")}},
+		{`{"enabled": 0}`, fields{newField("enabled", false, "")}},
+		{`{"code": 12345678901234567890}`, fields{newField("code", "12345678901234567890", "")}},
+		{`{"code": {"a": 1}}`, fields{newField("code", `{"a":1}`, "")}},
+		{`{"raw": "bytes"}`, fields{newField("raw", []byte("bytes"), "")}},
+		{`{"blob": "a string"}`, fields{newField("blob", []byte(`"a string"`), "json")}},
+		{`{"when": "2015-10-10T10:10:10Z"}`, fields{newField("when", time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano(), "")}},
+		{`{"when": 1444471810000}`, fields{newField("when", time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano(), "")}},
+		{`{"o": {"n": 1}}`, fields{newField("o", []byte(`{"n":1}`), "json")}},
+		{`{"other": 1.5}`, fields{newField("other", 1.5, "")}},
+	}
+
+	for _, c := range cases {
+		dt.testDecode(c.in, c.wantFields)
+	}
+
+	dt.testDecodeError(`{"id": "forty-two"}`, ContainSubstring("Cannot convert id to int"))
+	dt.testDecodeError(`{"id": 4.2}`, ContainSubstring("Cannot convert id to int"))
+	dt.testDecodeError(`{"when": true}`, ContainSubstring("Cannot convert when to timestamp"))
+}
+
+func TestDecodeFieldTypesFlatten(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		Flatten:    true,
+		FieldTypes: map[string]string{"o.n": "int", "o.s": "double"},
+	})
+	dt.testDecode(`{"o": {"n": 1, "s": "2.5"}}`, fields{newField("o.n", int64(1), ""), newField("o.s", 2.5, "")})
+}
+
+func TestDecodeFieldTypesBadConfig(t *testing.T) {
+	RegisterTestingT(t)
+	err := (&hekalocal.JSONDecoder{}).Init(&hekalocal.JSONDecoderConfig{FieldTypes: map[string]string{"a": "float"}})
+	Expect(err).To(HaveOccurred())
+}
+
+func TestDecodeFieldRepresentations(t *testing.T) {
+	reps := map[string]string{
+		"duration":     "ms",
+		"*.bytes":      "B",
+		"**.latency":   "us",
+		"http.latency": "s",
+	}
+	cases := []struct {
+		flatten    bool
+		in         string
+		wantFields fields
+	}{
+		{false, `{"duration": 12, "size": 4}`, fields{newField("duration", 12.0, "ms"), newField("size", 4.0, "")}},
+		{false, `{"http": {"bytes": 10}}`, fields{newField("http", []byte(`{"bytes":10}`), "json")}},
+		{true, `{"http": {"bytes": 10, "latency": 3}}`, fields{newField("http.bytes", 10.0, "B"), newField("http.latency", 3.0, "s")}},
+		{true, `{"a": {"bytes": {"bytes": 1}}}`, fields{newField("a.bytes.bytes", 1.0, "")}},
+		{true, `{"a": {"b": {"latency": 3}}}`, fields{newField("a.b.latency", 3.0, "us")}},
+	}
+
+	for _, c := range cases {
+		dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{Flatten: c.flatten, FieldRepresentations: reps})
+		dt.testDecode(c.in, c.wantFields)
+	}
+}
+
+func TestDecodeFailMode(t *testing.T) {
+	cases := []struct {
+		mode      string
+		wantPacks int
+		wantErr   bool
+	}{
+		{"", 1, false},
+		{"tag", 1, false},
+		{"drop", 0, false},
+		{"error", 0, true},
+	}
+
+	for _, c := range cases {
+		dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+			ErrorType:   "decode_failure",
+			ErrorLogger: "dead_letter",
+			FailMode:    c.mode,
+		})
+		payload := "not json"
+		dt.pack = &pipeline.PipelinePack{}
+		dt.pack.Message = &message.Message{Payload: &payload}
+		dt.pack.Message.SetType("orig")
+		packs, err := dt.decoder.Decode(dt.pack)
+		Expect(packs).To(HaveLen(c.wantPacks))
+		if c.wantErr {
+			Expect(err).To(MatchError(ContainSubstring("invalid character 'o'")))
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		if c.wantPacks > 0 {
+			Expect(packs[0].Message.GetType()).To(Equal("decode_failure"))
+			Expect(packs[0].Message.GetLogger()).To(Equal("dead_letter"))
+		}
+
+		// Clean messages are left alone.
+		dt.testDecode(`{"ok": true}`, fields{newField("ok", true, "")})
+		Expect(dt.pack.Message.GetType()).To(Equal(""))
+	}
+
+	err := (&hekalocal.JSONDecoder{}).Init(&hekalocal.JSONDecoderConfig{FailMode: "explode"})
+	Expect(err).To(HaveOccurred())
+}
+
+func TestDecodeSplitPayloadDrop(t *testing.T) {
+	decoder := &hekalocal.JSONDecoder{}
+	supplier := newPackSupplier()
+	decoder.SetDecoderRunner(supplier)
+	dt := newDecoderTester(t, decoder, &hekalocal.JSONDecoderConfig{SplitPayload: true, FailMode: "drop"})
+
+	payload := "{\"n\": oops}\n{\"n\": 2}\n{\"n\": oops}\n{\"n\": 4}"
+	dt.pack = &pipeline.PipelinePack{}
+	dt.pack.Message = &message.Message{Payload: &payload}
+	packs, err := dt.decoder.Decode(dt.pack)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs).To(HaveLen(2))
+	Expect(packs[0]).To(BeIdenticalTo(dt.pack))
+	Expect(packs[0].Message.GetPayload()).To(Equal(`{"n": 2}`))
+	Expect(packs[1].Message.GetPayload()).To(Equal(`{"n": 4}`))
+	Expect(supplier.recycleChan).To(HaveLen(2))
+}
+
+func TestDecodeSplitPayloadWithoutRunner(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{SplitPayload: true})
+
+	dt.testDecode(`{"n": 1}`, fields{newField("n", 1.0, "")})
+
+	payload := "{\"n\": 1}\n{\"n\": 2}"
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).To(HaveOccurred())
+	Expect(packs).To(BeNil())
+}
+
+func TestDecodeRedact(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		HostnameField: "host",
+		Flatten:       true,
+		Redact: hekalocal.RedactConfig{
+			HMACKey: "secret",
+			Rules: []hekalocal.RedactRule{
+				{Path: "user.email", Action: "hash"},
+				{Path: "card", Action: "mask", Length: 4},
+				{Path: "user.name", Action: "truncate", Length: 1},
+				{Path: "tokens.*", Action: "mask"},
+				{Path: "host", Action: "replace", Pattern: `^[^.]+`, Replacement: "x"},
+				{Path: "/^path$/", Action: "replace", Pattern: `\d+`, Replacement: "N"},
+			},
+		},
+	})
+
+	dt.testDecode(`{
+		"user": {"email": "a@example.com", "name": "Alice"},
+		"card": 4111111111111111,
+		"tokens": {"a": "abc", "b": true},
+		"host": "web1.example.com",
+		"path": "/users/123/orders/456",
+		"count": 3
+	}`, fields{
+		newField("user.email", "0607236cc2fc521ca815254262b7014cb54eb5488f266e4777158cc52a33cfe9", ""),
+		newField("user.name", "A", ""),
+		newField("card", "************1111", ""),
+		newField("tokens.a", "***", ""),
+		newField("tokens.b", "****", ""),
+		newField("path", "/users/N/orders/N", ""),
+		newField("count", 3.0, ""),
+	})
+	Expect(dt.pack.Message.GetHostname()).To(Equal("x.example.com"))
+	Expect(dt.pack.Message.GetPayload()).NotTo(ContainSubstring("a@example.com"))
+	Expect(dt.pack.Message.GetPayload()).NotTo(ContainSubstring("4111111111111111"))
+	Expect(dt.pack.Message.GetPayload()).To(ContainSubstring(`"name":"A"`))
+}
+
+func TestDecodeRedactObjects(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		Redact: hekalocal.RedactConfig{
+			HMACKey: "secret",
+			Rules:   []hekalocal.RedactRule{{Path: "user", Action: "hash"}},
+		},
+	})
+
+	dt.testDecode(`{"user": {"name": "Alice", "ids": [1, true]}}`, fields{
+		newField("user", []byte(`{"ids":["`+hmacHex("secret", "1")+`","`+hmacHex("secret", "true")+`"],"name":"`+hmacHex("secret", "Alice")+`"}`), "json"),
+	})
+}
+
+func TestDecodeRedactFieldTypes(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		FieldTypes: map[string]string{"ssn": "int", "ts": "timestamp", "raw": "bytes", "creds": "json"},
+		Redact: hekalocal.RedactConfig{
+			Rules: []hekalocal.RedactRule{
+				{Path: "ssn", Action: "mask", Length: 4},
+				{Path: "ts", Action: "truncate", Length: 4},
+				{Path: "raw", Action: "mask"},
+				{Path: "creds.pw", Action: "mask"},
+			},
+		},
+	})
+
+	dt.testDecode(`{"ssn": "123456789", "ts": 1444471810, "raw": "abc", "creds": {"pw": "hunter2", "user": "bob"}}`, fields{
+		newField("ssn", "*****6789", ""),
+		newField("ts", "1444", ""),
+		newField("raw", []byte("***"), ""),
+		newField("creds", []byte(`{"pw":"*******","user":"bob"}`), "json"),
+	})
+	Expect(dt.pack.Message.GetPayload()).NotTo(ContainSubstring("hunter2"))
+	Expect(dt.pack.Message.GetPayload()).NotTo(ContainSubstring("123456789"))
+
+	// Decode errors don't store a copy of the unredacted payload.
+	payload := `{"ts": "yesterday", "creds": {"pw": "hunter2"}}`
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.FindFirstField("decode_error.path").GetValue()).To(Equal("ts"))
+	Expect(packs[0].Message.GetPayload()).To(MatchJSON(`{"ts": "yest", "creds": {"pw": "*******"}}`))
+	Expect(packs[0].Message.FindFirstField("payload")).To(BeNil())
+
+	// Nor do errors found before the redaction.
+	dt = newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		ExpandJSONFields: []string{"doc"},
+		Redact:           hekalocal.RedactConfig{Rules: []hekalocal.RedactRule{{Path: "pw", Action: "mask"}}},
+	})
+	payload = `{"doc": "nope", "pw": "hunter2"}`
+	packs, err = dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.FindFirstField("decode_error.kind").GetValue()).To(Equal("expand"))
+	for _, field := range packs[0].Message.Fields {
+		Expect(field.String()).NotTo(ContainSubstring("hunter2"))
+	}
+}
+
+func hmacHex(key, s string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestDecodeRedactPatterns(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		Redact: hekalocal.RedactConfig{Patterns: []string{"credit_card", "email", "ipv4", "ipv6", "jwt"}},
+	})
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"mail bob@example.org now", "mail *************** now"},
+		{"card 4111 1111 1111 1111 ok", "card ******************* ok"},
+		{"order 1234567890123456", "order 1234567890123456"},
+		{"from 10.0.0.1 and fe80::1", "from ******** and *******"},
+		{"at 12:30:45", "at 12:30:45"},
+		{"auth eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig-_x", "auth " + strings.Repeat("*", 43)},
+	}
+
+	for _, c := range cases {
+		dt.testDecode(fmt.Sprintf(`{"msg": %q, "n": 4111111111111111}`, c.in), fields{
+			newField("msg", c.want, ""),
+			newField("n", "****************", ""),
+		})
+		Expect(dt.pack.Message.GetPayload()).To(ContainSubstring(c.want))
+	}
+
+	payload := `{"msg": "bob@example.org"`
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.FindFirstField("decode_error")).NotTo(BeNil())
+	Expect(packs[0].Message.GetPayload()).To(Equal(`{"msg": "***************"`))
+	Expect(packs[0].Message.FindFirstField("payload").GetValue()).To(Equal(`{"msg": "***************"`))
+}
+
+func TestDecodeRedactBadConfig(t *testing.T) {
+	RegisterTestingT(t)
+	for _, redact := range []hekalocal.RedactConfig{
+		{Rules: []hekalocal.RedactRule{{Path: "a", Action: "hash"}}},
+		{Rules: []hekalocal.RedactRule{{Path: "a", Action: "truncate"}}},
+		{Rules: []hekalocal.RedactRule{{Path: "a", Action: "replace", Pattern: "("}}},
+		{Rules: []hekalocal.RedactRule{{Path: "a", Action: "scramble"}}},
+		{Rules: []hekalocal.RedactRule{{Path: "a..b", Action: "mask"}}},
+		{Patterns: []string{"ssn"}},
+		{Patterns: []string{"email"}, PatternAction: "hash"},
+	} {
+		Expect((&hekalocal.JSONDecoder{}).Init(&hekalocal.JSONDecoderConfig{Redact: redact})).To(HaveOccurred())
+	}
+}
+
+func TestDecodeSchemaFile(t *testing.T) {
+	RegisterTestingT(t)
+	f, err := ioutil.TempFile("", "schema")
+	Expect(err).NotTo(HaveOccurred())
+	defer os.Remove(f.Name())
+	f.WriteString(`{
+		"type": "object",
+		"required": ["event"],
+		"properties": {
+			"event": {"type": "string", "enum": ["click", "view"]},
+			"user": {
+				"type": "object",
+				"properties": {"id": {"type": "integer", "minimum": 1}},
+				"additionalProperties": false
+			},
+			"tags": {"type": "array", "items": {"type": "string", "maxLength": 5}},
+			"ref": {"type": ["string", "null"], "pattern": "^r-"}
+		}
+	}`)
+	f.Close()
+
+	cases := []struct {
+		in          string
+		wantPaths   []string
+		wantMissing bool
+	}{
+		{`{"event": "click", "user": {"id": 3}, "tags": ["a"], "ref": null}`, nil, false},
+		{`{"event": "buy"}`, []string{"event"}, false},
+		{`{"user": {"id": 0, "name": "x"}}`, []string{"event", "user.id", "user.name"}, true},
+		{`{"event": "view", "tags": ["short", "toolong", 3], "ref": "x"}`, []string{"ref", "tags[1]", "tags[2]"}, false},
+	}
+
+	for _, strict := range []bool{false, true} {
+		dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+			SchemaFile:   f.Name(),
+			SchemaStrict: strict,
+			ErrorType:    "invalid",
+		})
+		for _, c := range cases {
+			payload := c.in
+			packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+			Expect(err).NotTo(HaveOccurred())
+			msg := packs[0].Message
+			if c.wantPaths == nil {
+				Expect(msg.FindFirstField("decode_error")).To(BeNil())
+				continue
+			}
+			Expect(msg.FindFirstField("decode_error.path").GetValueString()).To(Equal(c.wantPaths))
+			for _, kind := range msg.FindFirstField("decode_error.kind").GetValueString() {
+				Expect(kind).To(Equal("schema"))
+			}
+			// Only a missing required value still fails the message in strict mode.
+			Expect(msg.GetType() == "invalid").To(Equal(!strict || c.wantMissing))
+		}
+	}
+}
+
+func TestDecodeSchemaStrict(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		SchemaTypes:        map[string]string{"event": "string", "user.id": "integer", "tags": "array", "ref": "string?"},
+		SchemaStrict:       true,
+		DecodeErrorPayload: "drop",
+	})
+
+	dt.testDecode(`{"event": "click", "user": {"id": 3}, "tags": [], "ref": null}`, fields{
+		newField("event", "click", ""),
+		newField("user", []byte(`{"id":3}`), "json"),
+		newField("tags", []byte(`[]`), "json"),
+		newField("ref", []byte(`null`), "json"),
+	})
+
+	payload := `{"event": "click", "user": {"id": "3"}, "tags": "a", "extra": 1}`
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	msg := packs[0].Message
+	Expect(msg.FindFirstField("decode_error.path").GetValueString()).To(Equal([]string{"tags", "user.id"}))
+	Expect(msg.FindFirstField("event").GetValue()).To(Equal("click"))
+	Expect(msg.FindFirstField("extra").GetValue()).To(Equal(1.0))
+	Expect(msg.FindFirstField("tags")).To(BeNil())
+	Expect(msg.FindFirstField("user")).To(BeNil())
+}
+
+func TestDecodeSchemaTypes(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		SchemaTypes: map[string]string{"a": "object?", "a.b": "string", "raw": "string?", "doc": "object?", "doc.n": "integer"},
+		FieldTypes:  map[string]string{"raw": "bytes", "doc": "json"},
+	})
+
+	// An optional object may be left out, even though a value below it is required.
+	dt.testDecode(`{}`, nil)
+	dt.testDecode(`{"a": {"b": "x"}, "raw": "r", "doc": {"n": 1}}`, fields{
+		newField("a", []byte(`{"b":"x"}`), "json"),
+		newField("raw", []byte("r"), ""),
+		newField("doc", []byte(`{"n":1}`), "json"),
+	})
+
+	payload := `{"a": {}, "doc": {"n": "one"}}`
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.FindFirstField("decode_error.path").GetValueString()).To(Equal([]string{"a.b", "doc.n"}))
+}
+
+func TestDecodeSchemaBadConfig(t *testing.T) {
+	RegisterTestingT(t)
+	for _, conf := range []*hekalocal.JSONDecoderConfig{
+		{SchemaFile: "/nonexistent/schema.json"},
+		{SchemaTypes: map[string]string{"a": "text"}},
+		{SchemaFile: "/nonexistent/schema.json", SchemaTypes: map[string]string{"a": "string"}},
+	} {
+		Expect((&hekalocal.JSONDecoder{}).Init(conf)).To(HaveOccurred())
+	}
+}
+
+func TestDecodeSchemaUnsupportedKeywords(t *testing.T) {
+	RegisterTestingT(t)
+	for _, doc := range []string{
+		`{"oneOf": [{"type": "string"}, {"type": "integer"}]}`,
+		`{"properties": {"a": {"$ref": "#/definitions/a"}}}`,
+		`{"items": {"const": 1}}`,
+		`{"additionalProperties": {"format": "email"}}`,
+		`{"properties": {"n": {"type": "number", "exclusiveMinimum": 0}}}`,
+	} {
+		f, err := ioutil.TempFile("", "schema")
+		Expect(err).NotTo(HaveOccurred())
+		f.WriteString(doc)
+		f.Close()
+		err = (&hekalocal.JSONDecoder{}).Init(&hekalocal.JSONDecoderConfig{SchemaFile: f.Name()})
+		os.Remove(f.Name())
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Unsupported schema keyword"))
+	}
+}
+
+func TestDecodeSchemaIntegers(t *testing.T) {
+	// 1.0 is an integer whether it was decoded as a json.Number or converted to a double.
+	for _, fieldTypes := range []map[string]string{nil, {"n": "double"}} {
+		dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+			SchemaTypes: map[string]string{"n": "integer", "x": "integer?"},
+			FieldTypes:  fieldTypes,
+		})
+		payload := `{"n": 1.0, "x": 1.5}`
+		packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packs[0].Message.FindFirstField("decode_error.path").GetValueString()).To(Equal([]string{"x"}))
+	}
+}
+
+func TestDecodeProfiles(t *testing.T) {
+	noFlatten := false
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		TypeField:    "event_type",
+		Flatten:      true,
+		ProfileField: "event_type",
+		Profiles: map[string]*hekalocal.JSONDecoderProfile{
+			"click": {
+				MoveFields: map[string]string{"target.id": "target_id"},
+				FieldTypes: map[string]string{"x": "int"},
+			},
+			"error": {
+				Flatten:       &noFlatten,
+				SeverityField: "level",
+				RemoveFields:  []string{"stack"},
+			},
+			"nginx": {
+				MessageMatcher: "Logger == 'nginx'",
+				HostnameField:  "host",
+			},
+			"other": {
+				LoggerField: "app",
+			},
+		},
+		DefaultProfile: "other",
+	})
+
+	cases := []struct {
+		logger     string
+		in         string
+		wantFields fields
+		wantHeader func(*message.Message) string
+		wantValue  string
+	}{
+		{"", `{"event_type": "click", "x": "3", "target": {"id": "t1", "class": "btn"}}`, fields{
+			newField("x", int64(3), ""),
+			newField("target_id", "t1", ""),
+			newField("target.class", "btn", ""),
+		}, (*message.Message).GetType, "click"},
+		{"", `{"event_type": "error", "level": "err", "stack": "...", "ctx": {"a": 1}}`, fields{
+			newField("ctx", []byte(`{"a":1}`), "json"),
+		}, func(m *message.Message) string { return fmt.Sprint(m.GetSeverity()) }, "3"},
+		{"nginx", `{"host": "web1", "req": {"path": "/"}}`, fields{
+			newField("req.path", "/", ""),
+		}, (*message.Message).GetHostname, "web1"},
+		{"", `{"event_type": "view", "app": "shop", "page": {"id": 2}}`, fields{
+			newField("page.id", 2.0, ""),
+		}, (*message.Message).GetLogger, "shop"},
+	}
+
+	for _, c := range cases {
+		payload := c.in
+		msg := &message.Message{Payload: &payload}
+		if c.logger != "" {
+			msg.SetLogger(c.logger)
+		}
+		packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: msg})
+		Expect(err).NotTo(HaveOccurred())
+		sort.Sort(fields(packs[0].Message.Fields))
+		sort.Sort(c.wantFields)
+		Expect(packs[0].Message.Fields).To(Equal([]*message.Field(c.wantFields)))
+		Expect(c.wantHeader(packs[0].Message)).To(Equal(c.wantValue))
+	}
+}
+
+func TestDecodeProfilesEmpty(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		ProfileField: "kind",
+		Profiles: map[string]*hekalocal.JSONDecoderProfile{
+			"plain": nil,
+			"other": {Flatten: boolPtr(true)},
+		},
+		DefaultProfile: "plain",
+	})
+
+	dt.testDecode(`{"a": {"b": 1}}`, fields{newField("a", []byte(`{"b":1}`), "json")})
+	dt.testDecode(`{"kind": "other", "a": {"b": 1}}`, fields{
+		newField("kind", "other", ""),
+		newField("a.b", 1.0, ""),
+	})
+
+	Expect((&hekalocal.JSONDecoder{}).Init(&hekalocal.JSONDecoderConfig{
+		Profiles:       map[string]*hekalocal.JSONDecoderProfile{"plain": nil},
+		DefaultProfile: "plain",
+	})).To(Succeed())
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestDecodeProfilesBadConfig(t *testing.T) {
+	RegisterTestingT(t)
+	for _, conf := range []*hekalocal.JSONDecoderConfig{
+		{Profiles: map[string]*hekalocal.JSONDecoderProfile{"a": {}}, DefaultProfile: "b"},
+		{Profiles: map[string]*hekalocal.JSONDecoderProfile{"a": {MessageMatcher: "Logger =="}}},
+		{Profiles: map[string]*hekalocal.JSONDecoderProfile{"a": {FieldTypes: map[string]string{"x": "float"}}}},
+		{Profiles: map[string]*hekalocal.JSONDecoderProfile{"a": {RemoveFields: []string{"a[x]"}}}},
+	} {
+		Expect((&hekalocal.JSONDecoder{}).Init(conf)).To(HaveOccurred())
+	}
+}
+
+func TestDecodeExpandJSON(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		ExpandJSONFields:   []string{"message", "**.data"},
+		ExpandJSONMaxDepth: 2,
+		Flatten:            true,
+		MoveFields:         map[string]string{"message.user": "user"},
+	})
+
+	dt.testDecode(`{"message": "{\"user\": \"bob\", \"data\": \"{\\\"n\\\": 1}\"}", "other": "{\"a\": 1}"}`, fields{
+		newField("user", "bob", ""),
+		newField("message.data.n", 1.0, ""),
+		newField("other", `{"a": 1}`, ""),
+	})
+	dt.testDecode(`{"message": {"data": "[1, 2]"}}`, fields{
+		newField("message.data", []byte(`[1,2]`), "json"),
+	})
+
+	// Only one level of nesting is expanded by default.
+	dt = newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		ExpandJSONFields: []string{"message", "**.data"},
+	})
+	dt.testDecode(`{"message": "{\"data\": \"{\\\"n\\\": 1}\"}"}`, fields{
+		newField("message", []byte(`{"data":"{\"n\": 1}"}`), "json"),
+	})
+}
+
+func TestDecodeExpandJSONErrors(t *testing.T) {
+	dt := newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		ExpandJSONFields:   []string{"message", "data", "missing"},
+		ExpandJSONMaxDepth: 3,
+		ErrorType:          "invalid",
+		FailMode:           "drop",
+	})
+
+	payload := `{"message": "not json", "data": "42", "ok": 1}`
+	packs, err := dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	msg := packs[0].Message
+	Expect(msg.GetType()).To(Equal(""))
+	Expect(msg.FindFirstField("decode_error.kind").GetValueString()).To(Equal([]string{"expand", "expand"}))
+	Expect(msg.FindFirstField("decode_error.path").GetValueString()).To(Equal([]string{"message", "data"}))
+	Expect(msg.FindFirstField("message").GetValue()).To(Equal("not json"))
+	Expect(msg.FindFirstField("data").GetValue()).To(Equal("42"))
+	Expect(msg.FindFirstField("ok").GetValue()).To(Equal(1.0))
+	// The message is passed on as it is, so it doesn't need a copy of the payload.
+	Expect(msg.FindFirstField("payload")).To(BeNil())
+
+	// Other errors still fail the message.
+	payload = `{"message": "not json", "ok": 1`
+	packs, err = dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs).To(BeEmpty())
+
+	// And store the payload even after a tolerated error.
+	dt = newDecoderTester(t, &hekalocal.JSONDecoder{}, &hekalocal.JSONDecoderConfig{
+		ExpandJSONFields: []string{"message"},
+		TimestampField:   "ts",
+	})
+	payload = `{"message": "not json", "ts": "never"}`
+	packs, err = dt.decoder.Decode(&pipeline.PipelinePack{Message: &message.Message{Payload: &payload}})
+	Expect(err).NotTo(HaveOccurred())
+	msg = packs[0].Message
+	Expect(msg.FindFirstField("decode_error.kind").GetValueString()).To(Equal([]string{"expand", "timestamp"}))
+	Expect(msg.FindFirstField("payload").GetValueString()).To(Equal([]string{payload}))
+}
+
+func TestDecodeExpandJSONBadConfig(t *testing.T) {
+	RegisterTestingT(t)
+	for _, conf := range []*hekalocal.JSONDecoderConfig{
+		{ExpandJSONFields: []string{"a..b"}},
+		{ExpandJSONFields: []string{"/a(/"}},
+		{ExpandJSONFields: []string{"a"}, ExpandJSONMaxDepth: -1},
+	} {
+		Expect((&hekalocal.JSONDecoder{}).Init(conf)).To(HaveOccurred())
+	}
+}
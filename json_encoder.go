@@ -3,21 +3,21 @@ package hekalocal
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/pborman/uuid"
 
-	"github.com/OwnLocal/go-strftime"
-
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
-	"github.com/mozilla-services/heka/plugins/elasticsearch"
 )
 
 // JSONEncoder serializes messages to JSON.
 type JSONEncoder struct {
 	config *JSONEncoderConfig
-	coord  *elasticsearch.ElasticSearchCoordinates
+	bulk   *bulkHeader
 }
 
 type fieldEncoder func(map[string]interface{}, *message.Message)
@@ -33,12 +33,59 @@ type JSONEncoderConfig struct {
 	HostnameField   string `toml:"hostname_field"`
 	PIDField        string `toml:"pid_field"`
 
+	// How the severity is written: "number" (the default), "name", or "both".
+	SeverityFormat string           `toml:"severity_format"`
+	SeverityNames  map[string]int32 `toml:"severity_names"`
+
+	// How the timestamp is written: "rfc3339nano" (the default), "rfc3339", "epoch_*", or strftime.
+	TimestampFormat   string `toml:"timestamp_format"`
+	TimestampTimezone string `toml:"timestamp_timezone"`
+
+	// The index may mix strftime directives with %{Name} interpolation.
 	ElasticsearchBulk  bool   `toml:"elasticsearch_bulk"`
 	ElasticsearchIndex string `toml:"elasticsearch_index"`
 	ElasticsearchType  string `toml:"elasticsearch_type"`
 	ElasticsearchID    string `toml:"elasticsearch_id"`
 
-	fieldMap map[string]fieldEncoder
+	// Format the index with the current time instead of the message timestamp.
+	ElasticsearchIndexProcessingTime bool `toml:"elasticsearch_index_processing_time"`
+
+	// The bulk action: "index" (the default), "create", "update" or "delete".
+	ElasticsearchAction      string `toml:"elasticsearch_action"`
+	ElasticsearchDocAsUpsert bool   `toml:"elasticsearch_doc_as_upsert"`
+
+	// Optional bulk metadata, left out when it interpolates to nothing.
+	ElasticsearchRouting        string `toml:"elasticsearch_routing"`
+	ElasticsearchParent         string `toml:"elasticsearch_parent"`
+	ElasticsearchDocVersion     string `toml:"elasticsearch_doc_version"`
+	ElasticsearchDocVersionType string `toml:"elasticsearch_doc_version_type"`
+	ElasticsearchPipeline       string `toml:"elasticsearch_pipeline"`
+
+	// Typeless bulk headers for Elasticsearch 7+ and OpenSearch, and for data streams.
+	ElasticsearchOmitType   bool `toml:"elasticsearch_omit_type"`
+	ElasticsearchDataStream bool `toml:"elasticsearch_data_stream"`
+
+	// Multi-valued fields are written as arrays, except for these.
+	ScalarFields []string `toml:"scalar_fields"`
+
+	// How representations are written: "none" (the default), "unit" or "object".
+	RepresentationMode string `toml:"representation_mode"`
+
+	// Turn dotted field names back into nested objects.
+	NestDottedFields bool `toml:"nest_dotted_fields"`
+
+	RenameFields map[string]string `toml:"rename_fields"`
+	MoveFields   map[string]string `toml:"move_fields"`
+	KeepFields   []string          `toml:"keep_fields"`
+	RemoveFields []string          `toml:"remove_fields"`
+	// Only write the kept and moved values, plus the message headers.
+	StrictKeepFields bool `toml:"strict_keep_fields"`
+
+	fieldMap          map[string]fieldEncoder
+	scalarFields      map[string]bool
+	timestampLocation *time.Location
+	severities        *severityTable
+	pathRules         []*pathRule
 }
 
 // ConfigStruct is provided to make JSONEncoder implement the Heka pipeline.HasConfigStruct interface.
@@ -53,13 +100,44 @@ func (enc *JSONEncoder) ConfigStruct() interface{} {
 // Init is provided to make JSONEncoder implement the Heka pipeline.Plugin interface.
 func (enc *JSONEncoder) Init(config interface{}) (err error) {
 	enc.config = config.(*JSONEncoderConfig)
+	if enc.config.ElasticsearchDataStream {
+		switch enc.config.TimestampField {
+		case "":
+			enc.config.TimestampField = "@timestamp"
+		case "@timestamp":
+		default:
+			return fmt.Errorf("timestamp_field must be @timestamp for data streams, not %s", enc.config.TimestampField)
+		}
+	}
+	if err = enc.config.buildTimestampFormat(); err != nil {
+		return err
+	}
+	switch enc.config.SeverityFormat {
+	case "":
+		enc.config.SeverityFormat = "number"
+	case "number", "name", "both":
+	default:
+		return fmt.Errorf("Unknown severity_format: %s", enc.config.SeverityFormat)
+	}
+	if enc.config.severities, err = newSeverityTable(enc.config.SeverityNames); err != nil {
+		return err
+	}
 	enc.config.buildFieldMap()
-	enc.coord = &elasticsearch.ElasticSearchCoordinates{
-		Index:                enc.config.ElasticsearchIndex,
-		Type:                 enc.config.ElasticsearchType,
-		Id:                   enc.config.ElasticsearchID,
-		ESIndexFromTimestamp: true,
+	enc.config.scalarFields = make(map[string]bool, len(enc.config.ScalarFields))
+	for _, name := range enc.config.ScalarFields {
+		enc.config.scalarFields[name] = true
+	}
+	switch enc.config.RepresentationMode {
+	case "":
+		enc.config.RepresentationMode = "none"
+	case "none", "unit", "object":
+	default:
+		return fmt.Errorf("Unknown representation_mode: %s", enc.config.RepresentationMode)
 	}
+	if enc.bulk, err = newBulkHeader(enc.config); err != nil {
+		return err
+	}
+	enc.config.pathRules, err = buildPathRules(enc.config.MoveFields, enc.config.KeepFields, enc.config.RemoveFields)
 	return
 }
 
@@ -67,35 +145,264 @@ func (enc *JSONEncoder) Init(config interface{}) (err error) {
 func (enc *JSONEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
 	rawMap := make(map[string]interface{})
 	for _, field := range pack.Message.GetFields() {
-		if field.GetValueType() == message.Field_BYTES && field.GetRepresentation() == "json" {
-			rawMap[field.GetName()] = (*json.RawMessage)(&field.GetValueBytes()[0])
-		} else {
-			rawMap[field.GetName()] = field.GetValue()
+		enc.config.encodeField(rawMap, field)
+	}
+
+	if enc.config.NestDottedFields {
+		if err = nestDottedFields(rawMap); err != nil {
+			return nil, err
 		}
 	}
 
-	for _, encodeFn := range enc.config.fieldMap {
-		encodeFn(rawMap, pack.Message)
+	if len(enc.config.pathRules) > 0 {
+		if rawMap, err = enc.config.applyPathRules(rawMap); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = enc.config.encodeHeaders(rawMap, pack.Message); err != nil {
+		return nil, err
 	}
 
 	buf := &bytes.Buffer{}
+	var doc interface{} = rawMap
 	if enc.config.ElasticsearchBulk {
-		coordCopy := *(enc.coord)
-		coordCopy.Index = strftime.Format(enc.coord.Index, time.Unix(0, pack.Message.GetTimestamp()).UTC())
-		coordCopy.PopulateBuffer(pack.Message, buf)
-		buf.WriteString("\n")
+		if err = enc.bulk.write(pack.Message, buf); err != nil {
+			return nil, err
+		}
+		switch enc.bulk.action {
+		case "delete":
+			return buf.Bytes(), nil
+		case "update":
+			update := map[string]interface{}{"doc": rawMap}
+			if enc.config.ElasticsearchDocAsUpsert {
+				update["doc_as_upsert"] = true
+			}
+			doc = update
+		}
 	}
 
 	jsonEnc := json.NewEncoder(buf)
-	err = jsonEnc.Encode(rawMap)
+	err = jsonEnc.Encode(doc)
 	output = buf.Bytes()
 	return
 }
 
+// encodeHeaders adds the configured message headers to rawMap. With nest_dotted_fields enabled
+// they are nested like the fields, and must not collide with them; otherwise they replace any
+// field with the same name.
+func (conf *JSONEncoderConfig) encodeHeaders(rawMap map[string]interface{}, msg *message.Message) error {
+	if !conf.NestDottedFields {
+		for _, encodeFn := range conf.fieldMap {
+			encodeFn(rawMap, msg)
+		}
+		return nil
+	}
+
+	headers := make(map[string]interface{}, len(conf.fieldMap))
+	for _, encodeFn := range conf.fieldMap {
+		encodeFn(headers, msg)
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	// Sort so that collisions are reported consistently.
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := setNested(rawMap, strings.Split(key, "."), headers[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeField adds field to rawMap, as an array if it has several values, along with its
+// representation according to the representation mode.
+func (conf *JSONEncoderConfig) encodeField(rawMap map[string]interface{}, field *message.Field) {
+	rep := field.GetRepresentation()
+	vals := fieldValues(field)
+	if len(vals) == 0 {
+		return
+	}
+	if rep == "json" {
+		for i, val := range vals {
+			vals[i] = rawJSONValue(val)
+		}
+	}
+
+	var val interface{} = vals
+	if len(vals) == 1 || conf.scalarFields[field.GetName()] {
+		val = vals[0]
+	}
+
+	name := field.GetName()
+	if rename, ok := conf.RenameFields[name]; ok {
+		name = rename
+	}
+	switch {
+	case rep == "" || rep == "json" || conf.RepresentationMode == "none":
+		rawMap[name] = val
+	case conf.RepresentationMode == "unit":
+		rawMap[name] = val
+		rawMap[name+"_unit"] = rep
+	case conf.RepresentationMode == "object":
+		rawMap[name] = map[string]interface{}{"value": val, "representation": rep}
+	}
+}
+
+// rawJSONValue returns bytes, and strings holding valid JSON, as raw JSON so that they are
+// included in the output as is.
+func rawJSONValue(val interface{}) interface{} {
+	switch t := val.(type) {
+	case []byte:
+		return json.RawMessage(t)
+	case string:
+		var v interface{}
+		if json.Unmarshal([]byte(t), &v) == nil {
+			return json.RawMessage(t)
+		}
+	}
+	return val
+}
+
+// applyPathRules moves, keeps and removes values in rawMap, returning the updated map.
+func (conf *JSONEncoderConfig) applyPathRules(rawMap map[string]interface{}) (map[string]interface{}, error) {
+	for key, val := range rawMap {
+		if raw, ok := val.(json.RawMessage); ok {
+			rawMap[key] = decodeRawJSON(raw)
+		}
+	}
+
+	var moved []movedValue
+	for _, rule := range conf.pathRules {
+		if rule.keep && !conf.StrictKeepFields {
+			continue
+		}
+		moved = append(moved, rule.extract(rawMap)...)
+	}
+	if conf.StrictKeepFields {
+		rawMap = make(map[string]interface{}, len(moved))
+	}
+	for _, m := range moved {
+		if err := dottedSet(rawMap, m.to, m.val); err != nil {
+			return nil, fmt.Errorf("Cannot move value to %s: %s", m.to, err.Error())
+		}
+	}
+	return rawMap, nil
+}
+
+// nestDottedFields moves every value in rawMap with a dotted key into nested objects.
+func nestDottedFields(rawMap map[string]interface{}) error {
+	var dotted []string
+	for key := range rawMap {
+		if strings.Contains(key, ".") {
+			dotted = append(dotted, key)
+		}
+	}
+	// Sort so that collisions are reported consistently.
+	sort.Strings(dotted)
+
+	for _, key := range dotted {
+		val := rawMap[key]
+		delete(rawMap, key)
+		if err := setNested(rawMap, strings.Split(key, "."), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setNested stores val at the path given by keys, creating objects along the way and decoding
+// raw JSON objects so that values can be merged into them.
+func setNested(m map[string]interface{}, keys []string, val interface{}) error {
+	for i, key := range keys {
+		existing, exists := m[key]
+		if i == len(keys)-1 {
+			if exists {
+				return fmt.Errorf("Dotted field collides with an existing value: %s", strings.Join(keys, "."))
+			}
+			m[key] = val
+			return nil
+		}
+
+		if raw, ok := existing.(json.RawMessage); ok {
+			existing = decodeRawJSON(raw)
+		}
+		child, ok := existing.(map[string]interface{})
+		if !ok {
+			if exists {
+				return fmt.Errorf("Dotted field collides with a non-object value: %s", strings.Join(keys[:i+1], "."))
+			}
+			child = map[string]interface{}{}
+		}
+		m[key] = child
+		m = child
+	}
+	return nil
+}
+
+// decodeRawJSON returns raw decoded, keeping numbers exact, or raw unchanged if it isn't valid.
+func decodeRawJSON(raw json.RawMessage) interface{} {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return raw
+	}
+	return v
+}
+
+func (conf *JSONEncoderConfig) buildTimestampFormat() error {
+	switch conf.TimestampFormat {
+	case "":
+		conf.TimestampFormat = "rfc3339nano"
+	case "rfc3339nano", "rfc3339", "epoch_s", "epoch_ms", "epoch_us", "epoch_ns":
+	default:
+		if !strings.Contains(conf.TimestampFormat, "%") {
+			return fmt.Errorf("Unknown timestamp_format: %s", conf.TimestampFormat)
+		}
+		if err := checkStrftimeFormat(conf.TimestampFormat, false); err != nil {
+			return err
+		}
+	}
+
+	conf.timestampLocation = time.UTC
+	if conf.TimestampTimezone != "" {
+		loc, err := time.LoadLocation(conf.TimestampTimezone)
+		if err != nil {
+			return fmt.Errorf("Invalid timestamp_timezone: %s", err.Error())
+		}
+		conf.timestampLocation = loc
+	}
+	return nil
+}
+
 func (conf *JSONEncoderConfig) encodeTimestamp(rawMap map[string]interface{}, msg *message.Message) {
-	if msg.Timestamp != nil {
-		rawMap[conf.TimestampField] = time.Unix(0, *msg.Timestamp).UTC()
+	if msg.Timestamp == nil {
+		return
 	}
+	ns := *msg.Timestamp
+	t := time.Unix(0, ns).In(conf.timestampLocation)
+
+	var val interface{}
+	switch conf.TimestampFormat {
+	case "rfc3339nano":
+		val = t
+	case "rfc3339":
+		val = t.Format(time.RFC3339)
+	case "epoch_s":
+		val = float64(ns) / float64(time.Second)
+	case "epoch_ms":
+		val = ns / int64(time.Millisecond)
+	case "epoch_us":
+		val = ns / int64(time.Microsecond)
+	case "epoch_ns":
+		val = ns
+	default:
+		val = formatTime(conf.TimestampFormat, t)
+	}
+	rawMap[conf.TimestampField] = val
 }
 
 func (conf *JSONEncoderConfig) encodeUUID(rawMap map[string]interface{}, msg *message.Message) {
@@ -105,7 +412,17 @@ func (conf *JSONEncoderConfig) encodeUUID(rawMap map[string]interface{}, msg *me
 }
 
 func (conf *JSONEncoderConfig) encodeSeverity(rawMap map[string]interface{}, msg *message.Message) {
-	rawMap[conf.SeverityField] = msg.GetSeverity()
+	severity := msg.GetSeverity()
+	name, named := conf.severities.name(severity)
+	switch {
+	case conf.SeverityFormat == "name" && named:
+		rawMap[conf.SeverityField] = name
+	case conf.SeverityFormat == "both" && named:
+		rawMap[conf.SeverityField] = severity
+		rawMap[conf.SeverityField+"_name"] = name
+	default:
+		rawMap[conf.SeverityField] = severity
+	}
 }
 
 func (conf *JSONEncoderConfig) encodePID(rawMap map[string]interface{}, msg *message.Message) {
@@ -29,6 +29,12 @@ func TestEncode(t *testing.T) {
 
 		{fields{newField("o", []byte("{}"), "json")}, `{"o":{}}`},
 		{fields{newField("o", []byte(`{"a":"b", "c": "d"}`), "json")}, `{"o":{"a":"b", "c": "d"}}`},
+		{fields{newField("o", `{"a":"b"}`, "json")}, `{"o":{"a":"b"}}`},
+		{fields{newField("o", `not json`, "json")}, `{"o":"not json"}`},
+
+		{fields{multiField("m", "a", "b")}, `{"m":["a","b"]}`},
+		{fields{multiField("m", 1.0, 2.0, 3.0)}, `{"m":[1,2,3]}`},
+		{fields{multiField("m", []byte(`{"a":1}`), []byte(`[2]`))}, `{"m":[{"a":1},[2]]}`},
 
 		{fields{
 			newField("s", "foo", ""),
@@ -57,6 +63,132 @@ func TestEncode(t *testing.T) {
 	}
 }
 
+func multiField(name string, vals ...interface{}) *message.Field {
+	rep := ""
+	if _, ok := vals[0].([]byte); ok {
+		rep = "json"
+	}
+	field := newField(name, vals[0], rep)
+	for _, val := range vals[1:] {
+		field.AddValue(val)
+	}
+	return field
+}
+
+func TestEncodeScalarFields(t *testing.T) {
+	et := newEncoderTester(t, &hekalocal.JSONEncoder{}, &hekalocal.JSONEncoderConfig{ScalarFields: []string{"s"}})
+	et.testEncode(&message.Message{Fields: fields{multiField("s", "a", "b"), multiField("m", "a", "b")}}, `{"s":"a","m":["a","b"]}`)
+}
+
+func TestEncodeRepresentation(t *testing.T) {
+	cases := []struct {
+		mode string
+		want string
+	}{
+		{"", `{"d":12,"m":[1,2],"o":{"a":1},"s":"x"}`},
+		{"none", `{"d":12,"m":[1,2],"o":{"a":1},"s":"x"}`},
+		{"unit", `{"d":12,"d_unit":"ms","m":[1,2],"m_unit":"B","o":{"a":1},"s":"x"}`},
+		{"object", `{"d":{"value":12,"representation":"ms"},"m":{"value":[1,2],"representation":"B"},"o":{"a":1},"s":"x"}`},
+	}
+
+	multi := newField("m", int64(1), "B")
+	multi.AddValue(int64(2))
+	msg := &message.Message{Fields: fields{
+		newField("d", 12.0, "ms"),
+		multi,
+		newField("o", []byte(`{"a":1}`), "json"),
+		newField("s", "x", ""),
+	}}
+	for _, c := range cases {
+		et := newEncoderTester(t, &hekalocal.JSONEncoder{}, &hekalocal.JSONEncoderConfig{RepresentationMode: c.mode})
+		et.testEncode(msg, c.want)
+	}
+
+	gomega.Expect((&hekalocal.JSONEncoder{}).Init(&hekalocal.JSONEncoderConfig{RepresentationMode: "suffix"})).To(gomega.HaveOccurred())
+}
+
+func TestEncodeNestDottedFields(t *testing.T) {
+	cases := []struct {
+		in   fields
+		want string
+	}{
+		{fields{newField("a.b.c", 1.0, ""), newField("a.b.d", "x", ""), newField("e", true, "")}, `{"a":{"b":{"c":1,"d":"x"}},"e":true}`},
+		{fields{newField("a", []byte(`{"b":{"c":12345678901234567890}}`), "json"), newField("a.b.d", 2.0, "")}, `{"a":{"b":{"c":12345678901234567890,"d":2}}}`},
+		{fields{newField("a.b", []byte(`[1,2]`), "json"), newField("a.c", 3.0, "ms")}, `{"a":{"b":[1,2],"c":3}}`},
+	}
+
+	et := newEncoderTester(t, &hekalocal.JSONEncoder{}, &hekalocal.JSONEncoderConfig{NestDottedFields: true})
+	for _, c := range cases {
+		et.testEncode(&message.Message{Fields: c.in}, c.want)
+	}
+
+	// Message headers are nested too, and collide like fields do.
+	et = newEncoderTester(t, &hekalocal.JSONEncoder{}, &hekalocal.JSONEncoderConfig{NestDottedFields: true, TypeField: "event.type"})
+	msg := &message.Message{Fields: fields{newField("event.id", 1.0, "")}}
+	msg.SetType("click")
+	et.testEncode(msg, `{"event":{"id":1,"type":"click"}}`)
+	msg.Fields = fields{newField("event.type", "view", "")}
+	_, err := et.doEncode(msg)
+	gomega.Expect(err).To(gomega.HaveOccurred())
+
+	et = newEncoderTester(t, &hekalocal.JSONEncoder{}, &hekalocal.JSONEncoderConfig{NestDottedFields: true})
+	for _, in := range []fields{
+		{newField("a", 1.0, ""), newField("a.b", 2.0, "")},
+		{newField("a.b", 1.0, ""), newField("a.b.c", 2.0, "")},
+		{newField("a", []byte(`{"b":1}`), "json"), newField("a.b", 2.0, "")},
+		{newField("a", []byte(`[1]`), "json"), newField("a.b", 2.0, "")},
+	} {
+		_, err := et.doEncode(&message.Message{Fields: in})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	}
+}
+
+func TestEncodeFieldPaths(t *testing.T) {
+	in := fields{
+		newField("user", []byte(`{"name": "n", "email": "e@example.com", "ids": [1, 2]}`), "json"),
+		newField("card.number", "4111", ""),
+		newField("msg", "hello", ""),
+	}
+	cases := []struct {
+		conf hekalocal.JSONEncoderConfig
+		want string
+	}{
+		{
+			hekalocal.JSONEncoderConfig{RenameFields: map[string]string{"msg": "message"}},
+			`{"user": {"name": "n", "email": "e@example.com", "ids": [1, 2]}, "card.number": "4111", "message": "hello"}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{RemoveFields: []string{"user.email", "user.ids[0]"}, NestDottedFields: true},
+			`{"user": {"name": "n", "ids": [null, 2]}, "card": {"number": "4111"}, "msg": "hello"}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{MoveFields: map[string]string{"user.name": "username", "card.*": "payment.$1"}, NestDottedFields: true},
+			`{"user": {"email": "e@example.com", "ids": [1, 2]}, "username": "n", "payment": {"number": "4111"}, "msg": "hello"}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{KeepFields: []string{"user.name", "msg"}, MoveFields: map[string]string{"user.ids": "ids"}, TypeField: "type"},
+			`{"user": {"name": "n", "email": "e@example.com"}, "ids": [1, 2], "card.number": "4111", "msg": "hello", "type": "t"}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{KeepFields: []string{"user.ids[0]"}},
+			`{"user": {"name": "n", "email": "e@example.com", "ids": [1, 2]}, "card.number": "4111", "msg": "hello"}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{KeepFields: []string{"user.name", "msg"}, MoveFields: map[string]string{"user.ids": "ids"}, TypeField: "type", StrictKeepFields: true},
+			`{"user": {"name": "n"}, "ids": [1, 2], "msg": "hello", "type": "t"}`,
+		},
+	}
+
+	for _, c := range cases {
+		et := newEncoderTester(t, &hekalocal.JSONEncoder{}, &c.conf)
+		msg := &message.Message{Fields: in}
+		msg.SetType("t")
+		et.testEncode(msg, c.want)
+	}
+
+	gomega.Expect((&hekalocal.JSONEncoder{}).Init(&hekalocal.JSONEncoderConfig{RemoveFields: []string{"a[x]"}})).To(gomega.HaveOccurred())
+}
+
 func intPtr(i int64) *int64 {
 	return &i
 }
@@ -76,6 +208,45 @@ func TestEncodeTimestamp(t *testing.T) {
 	}
 }
 
+func TestEncodeTimestampFormat(t *testing.T) {
+	ts := time.Date(2015, 10, 10, 10, 10, 10, 123456789, time.UTC).UnixNano()
+	cases := []struct {
+		format   string
+		timezone string
+		wantJSON string
+	}{
+		{"", "", `{"ts": "2015-10-10T10:10:10.123456789Z"}`},
+		{"rfc3339nano", "America/Chicago", `{"ts": "2015-10-10T05:10:10.123456789-05:00"}`},
+		{"rfc3339", "", `{"ts": "2015-10-10T10:10:10Z"}`},
+		{"epoch_s", "", `{"ts": 1444471810.1234567}`},
+		{"epoch_ms", "", `{"ts": 1444471810123}`},
+		{"epoch_us", "", `{"ts": 1444471810123456}`},
+		{"epoch_ns", "", `{"ts": 1444471810123456789}`},
+		{"%Y-%m-%d %H:%M:%S", "", `{"ts": "2015-10-10 10:10:10"}`},
+		{"%Y-%m-%d %H:%M:%S", "Asia/Tokyo", `{"ts": "2015-10-10 19:10:10"}`},
+		{"%H:%M:%S%L (%Gw%V)", "", `{"ts": "10:10:10.123 (2015w41)"}`},
+	}
+
+	for _, c := range cases {
+		et := newEncoderTester(t, &hekalocal.JSONEncoder{}, &hekalocal.JSONEncoderConfig{
+			TimestampField:    "ts",
+			TimestampFormat:   c.format,
+			TimestampTimezone: c.timezone,
+		})
+		et.testEncode(&message.Message{Timestamp: intPtr(ts)}, c.wantJSON)
+	}
+
+	for _, conf := range []*hekalocal.JSONEncoderConfig{
+		{TimestampField: "ts", TimestampFormat: "epoch"},
+		{TimestampField: "ts", TimestampFormat: "%Y-%m-%d %Q"},
+		{TimestampField: "ts", TimestampFormat: "%Y-%{Logger}"},
+		{TimestampField: "ts", TimestampFormat: "%Y%"},
+		{TimestampField: "ts", TimestampTimezone: "Nowhere/Special"},
+	} {
+		gomega.Expect((&hekalocal.JSONEncoder{}).Init(conf)).To(gomega.HaveOccurred())
+	}
+}
+
 func TestEncodeUUID(t *testing.T) {
 	cases := []struct {
 		in       uuid.UUID
@@ -114,6 +285,35 @@ func TestEncodeSeverityDefault(t *testing.T) {
 	et.testEncode(&message.Message{}, `{"severity": 7}`)
 }
 
+func TestEncodeSeverityFormat(t *testing.T) {
+	cases := []struct {
+		format   string
+		names    map[string]int32
+		in       int32
+		wantJSON string
+	}{
+		{"number", nil, 3, `{"severity": 3}`},
+		{"name", nil, 3, `{"severity": "err"}`},
+		{"name", nil, 4, `{"severity": "warning"}`},
+		{"name", nil, 53, `{"severity": 53}`},
+		{"both", nil, 0, `{"severity": 0, "severity_name": "emerg"}`},
+		{"both", nil, 53, `{"severity": 53}`},
+		{"name", map[string]int32{"error": 3, "fail": 3}, 3, `{"severity": "error"}`},
+		{"name", map[string]int32{"verbose": 8}, 8, `{"severity": "verbose"}`},
+	}
+
+	for _, c := range cases {
+		et := newEncoderTester(t, &hekalocal.JSONEncoder{}, &hekalocal.JSONEncoderConfig{
+			SeverityField:  "severity",
+			SeverityFormat: c.format,
+			SeverityNames:  c.names,
+		})
+		et.testEncode(&message.Message{Severity: int32Ptr(c.in)}, c.wantJSON)
+	}
+
+	gomega.Expect((&hekalocal.JSONEncoder{}).Init(&hekalocal.JSONEncoderConfig{SeverityFormat: "text"})).To(gomega.HaveOccurred())
+}
+
 func TestEncodeStringFields(t *testing.T) {
 	conf := hekalocal.JSONEncoderConfig{}
 
@@ -216,3 +416,190 @@ func TestAddBulkHeaderWithWeek(t *testing.T) {
 	gomega.Expect(parts[0]).To(gomega.MatchJSON(`{"index": {"_index": "heka-2017w04", "_type": "test_log", "_id":"de305d54-75b4-431b-adb2-eb6b9e546014"}}`))
 	gomega.Expect(parts[1]).To(gomega.MatchJSON(`{"foo": "bar"}`))
 }
+
+func TestBulkActions(t *testing.T) {
+	cases := []struct {
+		conf       hekalocal.JSONEncoderConfig
+		wantHeader string
+		wantDoc    string
+	}{
+		{
+			hekalocal.JSONEncoderConfig{ElasticsearchAction: "create"},
+			`{"create": {"_index": "heka-2015.10", "_type": "test_log", "_id": "de305d54-75b4-431b-adb2-eb6b9e546014"}}`,
+			`{"foo": "bar", "user": "u1"}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{ElasticsearchAction: "update"},
+			`{"update": {"_index": "heka-2015.10", "_type": "test_log", "_id": "de305d54-75b4-431b-adb2-eb6b9e546014"}}`,
+			`{"doc": {"foo": "bar", "user": "u1"}}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{ElasticsearchAction: "update", ElasticsearchDocAsUpsert: true},
+			`{"update": {"_index": "heka-2015.10", "_type": "test_log", "_id": "de305d54-75b4-431b-adb2-eb6b9e546014"}}`,
+			`{"doc": {"foo": "bar", "user": "u1"}, "doc_as_upsert": true}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{ElasticsearchAction: "delete"},
+			`{"delete": {"_index": "heka-2015.10", "_type": "test_log", "_id": "de305d54-75b4-431b-adb2-eb6b9e546014"}}`,
+			"",
+		},
+		{
+			hekalocal.JSONEncoderConfig{
+				ElasticsearchRouting:        "%{user}",
+				ElasticsearchParent:         "%{parent}",
+				ElasticsearchDocVersion:     "%{Pid}",
+				ElasticsearchDocVersionType: "external",
+				ElasticsearchPipeline:       "%{Logger}-pipeline",
+			},
+			`{"index": {"_index": "heka-2015.10", "_type": "test_log", "_id": "de305d54-75b4-431b-adb2-eb6b9e546014",
+			  "_routing": "u1", "_version": 42, "_version_type": "external", "pipeline": "app-pipeline"}}`,
+			`{"foo": "bar", "user": "u1"}`,
+		},
+	}
+
+	for _, c := range cases {
+		c.conf.ElasticsearchBulk = true
+		c.conf.ElasticsearchIndex = "heka-%{2006.01}"
+		c.conf.ElasticsearchType = "%{Type}"
+		c.conf.ElasticsearchID = "%{UUID}"
+		et := newEncoderTester(t, &hekalocal.JSONEncoder{}, &c.conf)
+
+		msg := &message.Message{}
+		msg.SetType("test_log")
+		msg.SetLogger("app")
+		msg.SetPid(42)
+		msg.SetTimestamp(time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano())
+		msg.SetUuid(uuid.Parse("de305d54-75b4-431b-adb2-eb6b9e546014"))
+		message.NewStringField(msg, "foo", "bar")
+		message.NewStringField(msg, "user", "u1")
+
+		encoded, err := et.doEncode(msg)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		parts := bytes.Split(encoded, []byte("\n"))
+		gomega.Expect(parts[0]).To(gomega.MatchJSON(c.wantHeader))
+		if c.wantDoc == "" {
+			gomega.Expect(parts[1]).To(gomega.BeEmpty())
+		} else {
+			gomega.Expect(parts[1]).To(gomega.MatchJSON(c.wantDoc))
+		}
+	}
+}
+
+func TestBulkActionErrors(t *testing.T) {
+	gomega.RegisterTestingT(t)
+	gomega.Expect((&hekalocal.JSONEncoder{}).Init(&hekalocal.JSONEncoderConfig{ElasticsearchAction: "upsert"})).To(gomega.HaveOccurred())
+
+	for _, conf := range []*hekalocal.JSONEncoderConfig{
+		{ElasticsearchBulk: true, ElasticsearchAction: "delete", ElasticsearchID: "%{missing}"},
+		{ElasticsearchBulk: true, ElasticsearchDocVersion: "%{Type}"},
+	} {
+		et := newEncoderTester(t, &hekalocal.JSONEncoder{}, conf)
+		msg := &message.Message{}
+		msg.SetType("test_log")
+		_, err := et.doEncode(msg)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	}
+}
+
+func TestBulkTypeless(t *testing.T) {
+	cases := []struct {
+		conf       hekalocal.JSONEncoderConfig
+		wantHeader string
+		wantDoc    string
+	}{
+		{
+			hekalocal.JSONEncoderConfig{ElasticsearchOmitType: true, ElasticsearchRouting: "%{Logger}", ElasticsearchDocVersion: "%{Pid}"},
+			`{"index": {"_index": "logs", "_id": "de305d54-75b4-431b-adb2-eb6b9e546014", "routing": "app", "version": 42}}`,
+			`{"foo": "bar"}`,
+		},
+		{
+			hekalocal.JSONEncoderConfig{ElasticsearchDataStream: true},
+			`{"create": {"_index": "logs", "_id": "de305d54-75b4-431b-adb2-eb6b9e546014"}}`,
+			`{"@timestamp": "2015-10-10T10:10:10Z", "foo": "bar"}`,
+		},
+	}
+
+	for _, c := range cases {
+		c.conf.ElasticsearchBulk = true
+		c.conf.ElasticsearchIndex = "logs"
+		c.conf.ElasticsearchType = "%{Type}"
+		c.conf.ElasticsearchID = "%{UUID}"
+		et := newEncoderTester(t, &hekalocal.JSONEncoder{}, &c.conf)
+
+		msg := &message.Message{}
+		msg.SetType("test_log")
+		msg.SetLogger("app")
+		msg.SetPid(42)
+		msg.SetTimestamp(time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano())
+		msg.SetUuid(uuid.Parse("de305d54-75b4-431b-adb2-eb6b9e546014"))
+		message.NewStringField(msg, "foo", "bar")
+
+		encoded, err := et.doEncode(msg)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		parts := bytes.Split(encoded, []byte("\n"))
+		gomega.Expect(parts[0]).To(gomega.MatchJSON(c.wantHeader))
+		gomega.Expect(parts[1]).To(gomega.MatchJSON(c.wantDoc))
+	}
+
+	for _, conf := range []*hekalocal.JSONEncoderConfig{
+		{ElasticsearchDataStream: true, ElasticsearchAction: "index"},
+		{ElasticsearchDataStream: true, TimestampField: "ts"},
+		{ElasticsearchOmitType: true, ElasticsearchParent: "%{parent}"},
+	} {
+		gomega.Expect((&hekalocal.JSONEncoder{}).Init(conf)).To(gomega.HaveOccurred())
+	}
+}
+
+func TestBulkIndexTemplate(t *testing.T) {
+	cases := []struct {
+		index string
+		want  string
+	}{
+		{"logs-%{Logger}-%Y.%m.%d", "logs-web app-2015.10.10"},
+		{"logs-%{Logger|sanitize}-%Y.%m", "logs-web_app-2015.10"},
+		{"logs-%{Hostname|lowercase}", "logs-host1"},
+		{"logs-%{team|default:unknown}-%{2006}", "logs-unknown-2015"},
+		{"logs-%{service|default:none|sanitize}", "logs-api_v2"},
+	}
+
+	for _, c := range cases {
+		conf := &hekalocal.JSONEncoderConfig{ElasticsearchBulk: true, ElasticsearchIndex: c.index, ElasticsearchOmitType: true}
+		et := newEncoderTester(t, &hekalocal.JSONEncoder{}, conf)
+		msg := &message.Message{}
+		msg.SetLogger("Web App")
+		msg.SetHostname("HOST1")
+		msg.SetTimestamp(time.Date(2015, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano())
+		message.NewStringField(msg, "service", "api/v2")
+
+		encoded, err := et.doEncode(msg)
+		gomega.Expect(err).NotTo(gomega.HaveOccurred())
+		parts := bytes.Split(encoded, []byte("\n"))
+		gomega.Expect(parts[0]).To(gomega.MatchJSON(fmt.Sprintf(`{"index": {"_index": %q}}`, c.want)))
+	}
+
+	for _, index := range []string{"%{Logger|upper}", "logs-%Q", "logs-%Y%"} {
+		gomega.Expect((&hekalocal.JSONEncoder{}).Init(&hekalocal.JSONEncoderConfig{ElasticsearchIndex: index})).To(gomega.HaveOccurred())
+	}
+}
+
+func TestBulkIndexProcessingTime(t *testing.T) {
+	conf := &hekalocal.JSONEncoderConfig{
+		ElasticsearchBulk:                true,
+		ElasticsearchIndex:               "logs-%Y",
+		ElasticsearchOmitType:            true,
+		ElasticsearchIndexProcessingTime: true,
+	}
+	et := newEncoderTester(t, &hekalocal.JSONEncoder{}, conf)
+	msg := &message.Message{}
+	msg.SetTimestamp(time.Date(2005, 10, 10, 10, 10, 10, 0, time.UTC).UnixNano())
+
+	before := time.Now().UTC().Year()
+	encoded, err := et.doEncode(msg)
+	after := time.Now().UTC().Year()
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	parts := bytes.Split(encoded, []byte("\n"))
+	gomega.Expect(parts[0]).To(gomega.Or(
+		gomega.MatchJSON(fmt.Sprintf(`{"index": {"_index": "logs-%d"}}`, before)),
+		gomega.MatchJSON(fmt.Sprintf(`{"index": {"_index": "logs-%d"}}`, after)),
+	))
+}
@@ -0,0 +1,383 @@
+package hekalocal
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is a single step of a dotted path: either an object key or an array index.
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parsePath splits a dotted path such as "items[0].id" into its segments.
+func parsePath(path string) ([]pathSegment, error) {
+	var segs []pathSegment
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		var indices []pathSegment
+		for strings.HasSuffix(key, "]") {
+			open := strings.LastIndex(key, "[")
+			if open < 0 {
+				return nil, fmt.Errorf("Unbalanced brackets in path: %s", path)
+			}
+			i, err := strconv.Atoi(key[open+1 : len(key)-1])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("Invalid array index in path: %s", path)
+			}
+			indices = append([]pathSegment{{index: i, isIndex: true}}, indices...)
+			key = key[:open]
+		}
+		if key != "" {
+			segs = append(segs, pathSegment{key: key})
+		} else if len(indices) == 0 {
+			return nil, fmt.Errorf("Empty key in path: %s", path)
+		}
+		segs = append(segs, indices...)
+	}
+	return segs, nil
+}
+
+func dottedGet(m map[string]interface{}, path string) (interface{}, bool) {
+	segs, err := parsePath(path)
+	if err != nil {
+		return nil, false
+	}
+	var val interface{} = m
+	for _, seg := range segs {
+		var ok bool
+		if val, ok = segmentValue(val, seg); !ok {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+func segmentValue(container interface{}, seg pathSegment) (interface{}, bool) {
+	if seg.isIndex {
+		arr, ok := container.([]interface{})
+		if !ok || seg.index >= len(arr) {
+			return nil, false
+		}
+		return arr[seg.index], true
+	}
+	m, ok := container.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	val, exists := m[seg.key]
+	return val, exists
+}
+
+func dottedSet(m map[string]interface{}, path string, val interface{}) error {
+	segs, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	_, err = setPath(m, segs, val, "")
+	return err
+}
+
+// setPath stores val at segs below container, creating any missing objects and arrays along the
+// way, and returns the (possibly reallocated) container. The name is the key that led to the
+// container, for error messages.
+func setPath(container interface{}, segs []pathSegment, val interface{}, name string) (interface{}, error) {
+	seg := segs[0]
+	if seg.isIndex {
+		arr, ok := container.([]interface{})
+		if !ok && container != nil {
+			return nil, fmt.Errorf("Key does not refer to an array: %s", name)
+		}
+		for len(arr) <= seg.index {
+			arr = append(arr, nil)
+		}
+		if len(segs) == 1 {
+			arr[seg.index] = val
+			return arr, nil
+		}
+		child, err := setPath(arr[seg.index], segs[1:], val, fmt.Sprintf("%s[%d]", name, seg.index))
+		if err != nil {
+			return nil, err
+		}
+		arr[seg.index] = child
+		return arr, nil
+	}
+
+	m, ok := container.(map[string]interface{})
+	if !ok {
+		if container != nil {
+			return nil, fmt.Errorf("Key does not refer to an object: %s", name)
+		}
+		m = map[string]interface{}{}
+	}
+	if len(segs) == 1 {
+		m[seg.key] = val
+		return m, nil
+	}
+	child, err := setPath(m[seg.key], segs[1:], val, seg.key)
+	if err != nil {
+		return nil, err
+	}
+	m[seg.key] = child
+	return m, nil
+}
+
+func dottedRemove(m map[string]interface{}, path string) (interface{}, bool) {
+	segs, err := parsePath(path)
+	if err != nil || segs[0].isIndex {
+		return nil, false
+	}
+	_, val, exists := removePath(m, segs)
+	return val, exists
+}
+
+// removePath removes the value at segs below container and returns the updated container along
+// with the removed value. Array elements are replaced with null rather than removed, so that the
+// indices of the others don't change, and only the nulls left at the end are trimmed. Object keys
+// left holding an empty object or array by the removal are removed as well.
+func removePath(container interface{}, segs []pathSegment) (interface{}, interface{}, bool) {
+	seg := segs[0]
+	val, exists := segmentValue(container, seg)
+	if !exists {
+		return container, nil, false
+	}
+
+	if len(segs) > 1 {
+		var child interface{}
+		if child, val, exists = removePath(val, segs[1:]); !exists {
+			return container, nil, false
+		}
+		if seg.isIndex || !isEmptyContainer(child) {
+			return replaceSegment(container, seg, child), val, true
+		}
+	}
+
+	if seg.isIndex {
+		arr := container.([]interface{})
+		arr[seg.index] = nil
+		// Nulls at the end can go without shifting anything.
+		for len(arr) > 0 && arr[len(arr)-1] == nil {
+			arr = arr[:len(arr)-1]
+		}
+		return arr, val, true
+	}
+	delete(container.(map[string]interface{}), seg.key)
+	return container, val, true
+}
+
+func replaceSegment(container interface{}, seg pathSegment, val interface{}) interface{} {
+	if seg.isIndex {
+		container.([]interface{})[seg.index] = val
+	} else {
+		container.(map[string]interface{})[seg.key] = val
+	}
+	return container
+}
+
+func isEmptyContainer(val interface{}) bool {
+	switch t := val.(type) {
+	case map[string]interface{}:
+		return len(t) == 0
+	case []interface{}:
+		return len(t) == 0
+	}
+	return false
+}
+
+// walkPaths calls fn with the dotted path of every value below val, parents before children,
+// with object keys in sorted order and array elements in index order.
+func walkPaths(val interface{}, prefix string, fn func(path string)) {
+	switch t := val.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			fn(path)
+			walkPaths(t[key], path, fn)
+		}
+	case []interface{}:
+		for i, elem := range t {
+			path := fmt.Sprintf("%s[%d]", prefix, i)
+			fn(path)
+			walkPaths(elem, path, fn)
+		}
+	}
+}
+
+// matchPaths returns the paths in m matched by re, leaving out any path whose parent was
+// already matched.
+func matchPaths(m map[string]interface{}, re *regexp.Regexp) []string {
+	var matched []string
+	walkPaths(m, "", func(path string) {
+		if n := len(matched); n > 0 && isPathPrefix(matched[n-1], path) {
+			return
+		}
+		if re.MatchString(path) {
+			matched = append(matched, path)
+		}
+	})
+	return matched
+}
+
+func isPathPrefix(parent, path string) bool {
+	return strings.HasPrefix(path, parent) &&
+		len(path) > len(parent) && (path[len(parent)] == '.' || path[len(parent)] == '[')
+}
+
+// globToRegexp compiles a dotted path glob into a regular expression. A "*" matches within a single
+// path segment and a "**" matches across any number of segments, including none when it is
+// followed by a dot, so "**.id" matches "id" too. Each wildcard is a capture group.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**.") {
+				buf.WriteString(`(?:(.*)\.)?`)
+				i += 2
+			} else if i+1 < len(glob) && glob[i+1] == '*' {
+				buf.WriteString("(.*)")
+				i++
+			} else {
+				buf.WriteString("([^.]*)")
+			}
+		case '?':
+			buf.WriteString("([^.])")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?")
+}
+
+func isRegexPath(path string) bool {
+	return len(path) > 2 && strings.HasPrefix(path, "/") && strings.HasSuffix(path, "/")
+}
+
+// compilePathPattern returns the regular expression for a glob or a /regex/ path, or nil for a
+// literal path.
+func compilePathPattern(path string) (*regexp.Regexp, error) {
+	switch {
+	case isRegexPath(path):
+		return regexp.Compile(path[1 : len(path)-1])
+	case isGlob(path):
+		return globToRegexp(path)
+	}
+	return nil, nil
+}
+
+// pathRule moves the values found at a path, or at every path matching a pattern, to a new path.
+// An empty destination removes the values.
+type pathRule struct {
+	from string
+	to   string
+	keep bool
+	re   *regexp.Regexp
+}
+
+type movedValue struct {
+	to  string
+	val interface{}
+}
+
+func newPathRule(from, to string, keep bool) (*pathRule, error) {
+	re, err := compilePathPattern(from)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid path pattern %s: %s", from, err.Error())
+	}
+	if re == nil {
+		if _, err = parsePath(from); err != nil {
+			return nil, err
+		}
+	}
+	return &pathRule{from: from, to: to, keep: keep, re: re}, nil
+}
+
+// buildPathRules turns move/keep/remove settings into rules, literal paths first and patterns
+// after, each group sorted so that they are applied in a stable order.
+func buildPathRules(move map[string]string, keep, remove []string) ([]*pathRule, error) {
+	var rules []*pathRule
+	add := func(from, to string, keep bool) error {
+		rule, err := newPathRule(from, to, keep)
+		if err == nil {
+			rules = append(rules, rule)
+		}
+		return err
+	}
+	for from, to := range move {
+		if err := add(from, to, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range keep {
+		if err := add(path, path, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range remove {
+		if err := add(path, "", false); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(pathRules(rules))
+	return rules, nil
+}
+
+type pathRules []*pathRule
+
+// Implement sort.Interface to apply literal rules before patterns.
+func (r pathRules) Len() int { return len(r) }
+func (r pathRules) Less(i, j int) bool {
+	if (r[i].re == nil) != (r[j].re == nil) {
+		return r[i].re == nil
+	}
+	return r[i].from < r[j].from
+}
+func (r pathRules) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+// extract removes the values the rule applies to from m and returns where they should be moved.
+func (r *pathRule) extract(m map[string]interface{}) []movedValue {
+	if r.re == nil {
+		val, exists := dottedRemove(m, r.from)
+		if !exists || r.to == "" {
+			return nil
+		}
+		return []movedValue{{r.to, val}}
+	}
+
+	var moved []movedValue
+	paths := matchPaths(m, r.re)
+	// Work backwards so that removing array elements doesn't shift the later matches.
+	for i := len(paths) - 1; i >= 0; i-- {
+		path := paths[i]
+		val, exists := dottedRemove(m, path)
+		if !exists || r.to == "" {
+			continue
+		}
+		to := path
+		if !r.keep {
+			to = string(r.re.ExpandString(nil, r.to, path, r.re.FindStringSubmatchIndex(path)))
+		}
+		moved = append([]movedValue{{to, val}}, moved...)
+	}
+	return moved
+}
@@ -0,0 +1,431 @@
+package hekalocal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// RedactConfig holds the redaction settings shared by the plugins that support them. When there
+// are path rules, the payload is replaced with the redacted JSON, since the rules can only be
+// applied to parsed values.
+type RedactConfig struct {
+	// Key for the "hash" action, which replaces values with their hex HMAC-SHA256.
+	HMACKey string `toml:"hmac_key"`
+
+	// Rules applied to the values at the given paths, in order.
+	Rules []RedactRule `toml:"rules"`
+
+	// Named patterns to look for in every string value: "credit_card", "email", "ipv4", "ipv6"
+	// and "jwt". Matches are replaced according to pattern_action, "mask" (the default) or "hash".
+	Patterns      []string `toml:"patterns"`
+	PatternAction string   `toml:"pattern_action"`
+}
+
+// RedactRule redacts the values at a dotted path, glob or /regex/, as used by move_fields. Objects
+// and arrays at the path have every value below them redacted.
+type RedactRule struct {
+	Path string `toml:"path"`
+
+	// Action is one of:
+	//   "mask": replace every character with "*", leaving the last length characters visible.
+	//   "hash": replace the value with its hex HMAC-SHA256 under hmac_key.
+	//   "truncate": keep only the first length characters.
+	//   "replace": replace matches of the pattern regex with the replacement, which may refer to
+	//   capture groups as $1.
+	Action      string `toml:"action"`
+	Length      int    `toml:"length"`
+	Pattern     string `toml:"pattern"`
+	Replacement string `toml:"replacement"`
+}
+
+type redactFunc func(string) string
+
+type redactPathRule struct {
+	path string
+	re   *regexp.Regexp
+	fn   redactFunc
+}
+
+// scanPattern finds sensitive values in free text. Candidates found by re are only redacted if
+// valid returns true, when it is set.
+type scanPattern struct {
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+var scanPatterns = map[string]scanPattern{
+	"credit_card": {regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), luhnValid},
+	"email":       {regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), nil},
+	"ipv4":        {regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`), nil},
+	"ipv6":        {regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}(?:[0-9a-f]{1,4}|(?:\d{1,3}\.){3}\d{1,3})?`), isIPv6},
+	"jwt":         {regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), nil},
+}
+
+// redactor applies a RedactConfig to decoded JSON values and strings.
+type redactor struct {
+	rules         []redactPathRule
+	patterns      []scanPattern
+	patternAction redactFunc
+}
+
+func newRedactor(conf *RedactConfig) (*redactor, error) {
+	r := &redactor{}
+	hash := func(s string) string {
+		mac := hmac.New(sha256.New, []byte(conf.HMACKey))
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for _, rule := range conf.Rules {
+		re, err := compilePathPattern(rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redact path %s: %s", rule.Path, err.Error())
+		}
+		if re == nil {
+			if _, err = parsePath(rule.Path); err != nil {
+				return nil, err
+			}
+		}
+
+		var fn redactFunc
+		switch rule.Action {
+		case "mask":
+			fn = maskFunc(rule.Length)
+		case "hash":
+			if conf.HMACKey == "" {
+				return nil, fmt.Errorf("Redact action hash for %s requires hmac_key", rule.Path)
+			}
+			fn = hash
+		case "truncate":
+			if rule.Length <= 0 {
+				return nil, fmt.Errorf("Redact action truncate for %s requires a positive length", rule.Path)
+			}
+			fn = truncateFunc(rule.Length)
+		case "replace":
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil || rule.Pattern == "" {
+				return nil, fmt.Errorf("Redact action replace for %s requires a valid pattern", rule.Path)
+			}
+			replacement := rule.Replacement
+			fn = func(s string) string { return pattern.ReplaceAllString(s, replacement) }
+		default:
+			return nil, fmt.Errorf("Unknown redact action for %s: %s", rule.Path, rule.Action)
+		}
+		r.rules = append(r.rules, redactPathRule{rule.Path, re, fn})
+	}
+
+	for _, name := range conf.Patterns {
+		pattern, ok := scanPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown redact pattern: %s", name)
+		}
+		r.patterns = append(r.patterns, pattern)
+	}
+	switch conf.PatternAction {
+	case "", "mask":
+		r.patternAction = maskFunc(0)
+	case "hash":
+		if conf.HMACKey == "" && len(r.patterns) > 0 {
+			return nil, fmt.Errorf("Redact pattern_action hash requires hmac_key")
+		}
+		r.patternAction = hash
+	default:
+		return nil, fmt.Errorf("Unknown redact pattern_action: %s", conf.PatternAction)
+	}
+	return r, nil
+}
+
+// enabled reports whether there is anything to redact.
+func (r *redactor) enabled() bool {
+	return len(r.rules) > 0 || len(r.patterns) > 0
+}
+
+// redactMap applies the path rules and then the patterns to the values in m. Raw JSON values are
+// decoded while the rules are applied, so that paths can reach into them.
+func (r *redactor) redactMap(m map[string]interface{}) {
+	var raws []string
+	walkPaths(m, "", func(path string) {
+		if val, _ := dottedGet(m, path); val != nil {
+			if raw, ok := val.(json.RawMessage); ok {
+				if decoded := decodeRawJSON(raw); decoded != nil {
+					raws = append(raws, path)
+					dottedSet(m, path, decoded)
+				}
+			}
+		}
+	})
+	defer func() {
+		for _, path := range raws {
+			val, _ := dottedGet(m, path)
+			if enc, err := json.Marshal(val); err == nil {
+				dottedSet(m, path, json.RawMessage(enc))
+			}
+		}
+	}()
+
+	for _, rule := range r.rules {
+		if val, exists := m[rule.path]; exists && rule.re == nil {
+			// A key that is itself the dotted path, such as a flattened field name.
+			m[rule.path] = redactValue(val, rule.fn)
+			continue
+		}
+		paths := []string{rule.path}
+		if rule.re != nil {
+			paths = matchPaths(m, rule.re)
+		}
+		for _, path := range paths {
+			if val, exists := dottedGet(m, path); exists {
+				dottedSet(m, path, redactValue(val, rule.fn))
+			}
+		}
+	}
+	if len(r.patterns) > 0 {
+		for key, val := range m {
+			m[key] = redactValue(val, r.redactString)
+		}
+	}
+}
+
+// redactFields applies the rules and patterns to each of the message's fields, treating the field
+// name as the top-level key. Paths can reach into fields with the "json" representation. Numbers
+// and booleans that get redacted turn their field into a string field.
+func (r *redactor) redactFields(msg *message.Message) error {
+	for i, field := range msg.Fields {
+		isJSON := field.GetRepresentation() == "json" && field.GetValueType() == message.Field_BYTES
+		vals := fieldValues(field)
+		if len(vals) == 0 {
+			continue
+		}
+		for j, val := range vals {
+			if b, ok := val.([]byte); ok {
+				if isJSON {
+					vals[j] = decodeRawJSON(b)
+				} else {
+					vals[j] = string(b)
+				}
+			}
+		}
+
+		var val interface{} = vals
+		if len(vals) == 1 {
+			val = vals[0]
+		}
+		before, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		doc := map[string]interface{}{field.GetName(): val}
+		r.redactMap(doc)
+		val = doc[field.GetName()]
+		if after, err := json.Marshal(val); err != nil {
+			return err
+		} else if bytes.Equal(before, after) {
+			continue
+		}
+
+		if len(vals) > 1 {
+			vals = val.([]interface{})
+		} else {
+			vals = []interface{}{val}
+		}
+		if msg.Fields[i], err = redactedField(field, vals, isJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactedField builds a replacement for field holding the redacted values.
+func redactedField(field *message.Field, vals []interface{}, isJSON bool) (*message.Field, error) {
+	if isJSON {
+		for i, val := range vals {
+			enc, err := json.Marshal(val)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = enc
+		}
+	} else if field.GetValueType() == message.Field_BYTES {
+		for i, val := range vals {
+			vals[i] = []byte(val.(string))
+		}
+	} else if field.GetValueType() != message.Field_STRING {
+		// Redacting a number or boolean makes it a string, so make them all strings.
+		for i, val := range vals {
+			if _, ok := val.(string); !ok {
+				vals[i] = fmt.Sprint(val)
+			}
+		}
+	}
+
+	newField, err := message.NewField(field.GetName(), vals[0], field.GetRepresentation())
+	if err != nil {
+		return nil, err
+	}
+	for _, val := range vals[1:] {
+		if err = newField.AddValue(val); err != nil {
+			return nil, err
+		}
+	}
+	return newField, nil
+}
+
+// redactPayload applies the patterns to the message payload and to the payload field added when
+// decoding fails.
+func (r *redactor) redactPayload(msg *message.Message) {
+	if len(r.patterns) == 0 {
+		return
+	}
+	if msg.Payload != nil {
+		msg.SetPayload(r.redactString(msg.GetPayload()))
+	}
+	if field := msg.FindFirstField("payload"); field != nil && field.GetValueType() == message.Field_STRING {
+		vals := field.GetValueString()
+		for i, val := range vals {
+			vals[i] = r.redactString(val)
+		}
+	}
+}
+
+// redactJSONPayload applies the path rules to the payload, and to the payload field added when
+// decoding fails, when they hold a JSON object. Other payloads are left to the patterns.
+func (r *redactor) redactJSONPayload(msg *message.Message) {
+	if len(r.rules) == 0 {
+		return
+	}
+	if msg.Payload != nil {
+		msg.SetPayload(r.redactJSONString(msg.GetPayload()))
+	}
+	if field := msg.FindFirstField("payload"); field != nil && field.GetValueType() == message.Field_STRING {
+		vals := field.GetValueString()
+		for i, val := range vals {
+			vals[i] = r.redactJSONString(val)
+		}
+	}
+}
+
+// redactJSONString re-encodes s with the path rules applied if it is a JSON object that they
+// change, and otherwise returns it as it is.
+func (r *redactor) redactJSONString(s string) string {
+	doc := make(map[string]interface{})
+	if unmarshalJSON(s, &doc) != nil {
+		return s
+	}
+	before, err := json.Marshal(doc)
+	if err != nil {
+		return s
+	}
+	r.redactMap(doc)
+	after, err := json.Marshal(doc)
+	if err != nil || bytes.Equal(before, after) {
+		return s
+	}
+	return string(after)
+}
+
+// redactString replaces every match of the patterns in s.
+func (r *redactor) redactString(s string) string {
+	for _, pattern := range r.patterns {
+		valid := pattern.valid
+		s = pattern.re.ReplaceAllStringFunc(s, func(match string) string {
+			if valid != nil && !valid(match) {
+				return match
+			}
+			return r.patternAction(match)
+		})
+	}
+	return s
+}
+
+// redactValue applies fn to the string form of val, or of every value below it. Numbers and
+// booleans that fn changes become strings, while bytes keep their type.
+func redactValue(val interface{}, fn redactFunc) interface{} {
+	var s string
+	switch t := val.(type) {
+	case string:
+		return fn(t)
+	case []byte:
+		return []byte(fn(string(t)))
+	case json.Number:
+		s = t.String()
+	case float64:
+		s = strconv.FormatFloat(t, 'g', -1, 64)
+	case int64:
+		s = strconv.FormatInt(t, 10)
+	case bool:
+		s = strconv.FormatBool(t)
+	case map[string]interface{}:
+		for key, child := range t {
+			t[key] = redactValue(child, fn)
+		}
+		return val
+	case []interface{}:
+		for i, child := range t {
+			t[i] = redactValue(child, fn)
+		}
+		return val
+	default:
+		return val
+	}
+	if redacted := fn(s); redacted != s {
+		return redacted
+	}
+	return val
+}
+
+func maskFunc(visible int) redactFunc {
+	return func(s string) string {
+		n := utf8.RuneCountInString(s)
+		if visible >= n {
+			return s
+		}
+		runes := []rune(s)
+		return strings.Repeat("*", n-visible) + string(runes[n-visible:])
+	}
+}
+
+func truncateFunc(length int) redactFunc {
+	return func(s string) string {
+		runes := []rune(s)
+		if len(runes) <= length {
+			return s
+		}
+		return string(runes[:length])
+	}
+}
+
+// luhnValid checks the Luhn checksum of the digits in s, to tell card numbers from other long
+// numbers.
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func isIPv6(s string) bool {
+	return strings.Contains(s, ":") && net.ParseIP(s) != nil
+}
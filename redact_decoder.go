@@ -0,0 +1,45 @@
+package hekalocal
+
+import (
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// RedactDecoder applies the same redaction as the JSONDecoder redact section to messages from
+// any decoder, for example as the last step of a MultiDecoder. Rules apply to the message fields
+// and to payloads holding a JSON object, which are then re-encoded. Patterns apply to the fields
+// and to any payload.
+type RedactDecoder struct {
+	config   *RedactDecoderConfig
+	redactor *redactor
+}
+
+// RedactDecoderConfig contains the redaction settings.
+type RedactDecoderConfig struct {
+	Redact RedactConfig `toml:"redact"`
+}
+
+// ConfigStruct is provided to make RedactDecoder implement the Heka pipeline.HasConfigStruct interface.
+func (d *RedactDecoder) ConfigStruct() interface{} {
+	return new(RedactDecoderConfig)
+}
+
+// Init is provided to make RedactDecoder implement the Heka pipeline.Plugin interface.
+func (d *RedactDecoder) Init(config interface{}) (err error) {
+	d.config = config.(*RedactDecoderConfig)
+	d.redactor, err = newRedactor(&d.config.Redact)
+	return
+}
+
+// Decode is provided to make RedactDecoder implement the Heka pipeline.Decoder interface.
+func (d *RedactDecoder) Decode(pack *pipeline.PipelinePack) ([]*pipeline.PipelinePack, error) {
+	if err := d.redactor.redactFields(pack.Message); err != nil {
+		return nil, err
+	}
+	d.redactor.redactJSONPayload(pack.Message)
+	d.redactor.redactPayload(pack.Message)
+	return []*pipeline.PipelinePack{pack}, nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("RedactDecoder", func() interface{} { return new(RedactDecoder) })
+}
@@ -0,0 +1,112 @@
+package hekalocal_test
+
+import (
+	"testing"
+
+	"github.com/OwnLocal/heka-plugins"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	. "github.com/onsi/gomega"
+)
+
+func TestRedactDecoder(t *testing.T) {
+	RegisterTestingT(t)
+	d := hekalocal.RedactDecoder{}
+	Expect(d.Init(&hekalocal.RedactDecoderConfig{Redact: hekalocal.RedactConfig{
+		Rules: []hekalocal.RedactRule{
+			{Path: "user.email", Action: "mask", Length: 4},
+			{Path: "request.headers.authorization", Action: "mask"},
+			{Path: "pin", Action: "mask"},
+			{Path: "tags", Action: "truncate", Length: 2},
+		},
+		Patterns: []string{"ipv4"},
+	}})).To(Succeed())
+
+	tags := newField("tags", "alpha", "")
+	tags.AddValue("beta")
+	wantTags := newField("tags", "al", "")
+	wantTags.AddValue("be")
+
+	payload := `GET /login from 192.168.1.20 for a@example.com`
+	pack := &pipeline.PipelinePack{}
+	pack.Message = &message.Message{Payload: &payload, Fields: fields{
+		newField("user.email", "a@example.com", ""),
+		newField("request", []byte(`{"headers": {"authorization": "Bearer abc", "host": "h"}, "size": 12}`), "json"),
+		newField("pin", 1234.0, "digits"),
+		tags,
+		newField("remote_addr", "10.1.2.3", ""),
+		newField("status", 200.0, ""),
+	}}
+
+	packs, err := d.Decode(pack)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs).To(HaveLen(1))
+	msg := packs[0].Message
+	Expect(msg.GetPayload()).To(Equal(`GET /login from ************ for a@example.com`))
+	Expect(msg.Fields).To(Equal([]*message.Field{
+		newField("user.email", "*********.com", ""),
+		newField("request", []byte(`{"headers":{"authorization":"**********","host":"h"},"size":12}`), "json"),
+		newField("pin", "****", "digits"),
+		wantTags,
+		newField("remote_addr", "********", ""),
+		newField("status", 200.0, ""),
+	}))
+}
+
+func TestRedactDecoderJSONPayload(t *testing.T) {
+	RegisterTestingT(t)
+	d := hekalocal.RedactDecoder{}
+	Expect(d.Init(&hekalocal.RedactDecoderConfig{Redact: hekalocal.RedactConfig{
+		HMACKey: "secret",
+		Rules: []hekalocal.RedactRule{
+			{Path: "user", Action: "hash"},
+			{Path: "account", Action: "mask", Length: 2},
+			{Path: "phone", Action: "mask", Length: 2},
+		},
+	}})).To(Succeed())
+
+	payload := `{"user": {"email": "a@example.com"}, "account": 12345678, "ok": true}`
+	pack := &pipeline.PipelinePack{}
+	pack.Message = &message.Message{Payload: &payload, Fields: fields{
+		newField("account", int64(12345678), ""),
+		newField("phone", int64(5551234), "digits"),
+		newField("count", int64(3), ""),
+	}}
+
+	packs, err := d.Decode(pack)
+	Expect(err).NotTo(HaveOccurred())
+	msg := packs[0].Message
+	Expect(msg.GetPayload()).NotTo(ContainSubstring("a@example.com"))
+	Expect(msg.GetPayload()).To(ContainSubstring(`"account":"******78"`))
+	Expect(msg.GetPayload()).To(ContainSubstring(`"ok":true`))
+	Expect(msg.Fields).To(Equal([]*message.Field{
+		newField("account", "******78", ""),
+		newField("phone", "*****34", "digits"),
+		newField("count", int64(3), ""),
+	}))
+
+	// Payloads that aren't JSON objects are left alone.
+	payload = `account 12345678`
+	pack.Message = &message.Message{Payload: &payload}
+	packs, err = d.Decode(pack)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.GetPayload()).To(Equal(`account 12345678`))
+}
+
+func TestRedactDecoderUnchanged(t *testing.T) {
+	RegisterTestingT(t)
+	d := hekalocal.RedactDecoder{}
+	Expect(d.Init(&hekalocal.RedactDecoderConfig{Redact: hekalocal.RedactConfig{Patterns: []string{"email"}}})).To(Succeed())
+
+	in := fields{
+		newField("o", []byte(`{ "b": 1, "a": 2 }`), "json"),
+		newField("n", int64(5), "count"),
+	}
+	pack := &pipeline.PipelinePack{}
+	pack.Message = &message.Message{Fields: in}
+	packs, err := d.Decode(pack)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.Fields).To(Equal([]*message.Field(in)))
+
+	Expect((&hekalocal.RedactDecoder{}).Init(&hekalocal.RedactDecoderConfig{Redact: hekalocal.RedactConfig{Patterns: []string{"phone"}}})).To(HaveOccurred())
+}
@@ -0,0 +1,414 @@
+package hekalocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// schema is the subset of JSON Schema that decoded objects can be validated against: type,
+// properties, required, additionalProperties, items, enum, minimum, maximum, minLength,
+// maxLength, pattern, minItems and maxItems.
+type schema struct {
+	types                []string
+	properties           map[string]*schema
+	required             []string
+	additionalProperties *schema
+	noAdditional         bool
+	items                *schema
+	enum                 []interface{}
+	minimum, maximum     *float64
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	minItems, maxItems   *int
+}
+
+type jsonSchema struct {
+	Type                 json.RawMessage        `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+}
+
+// schemaKeywords are the keywords that compile understands, along with annotations that don't
+// affect validation. Any other keyword is rejected rather than silently ignored.
+var schemaKeywords = map[string]bool{
+	"type": true, "properties": true, "required": true, "additionalProperties": true, "items": true,
+	"enum": true, "minimum": true, "maximum": true, "minLength": true, "maxLength": true,
+	"pattern": true, "minItems": true, "maxItems": true,
+	"$schema": true, "$id": true, "id": true, "title": true, "description": true, "default": true,
+}
+
+// UnmarshalJSON rejects keywords outside the supported subset.
+func (js *jsonSchema) UnmarshalJSON(data []byte) error {
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return err
+	}
+	var unsupported []string
+	for k := range keywords {
+		if !schemaKeywords[k] {
+			unsupported = append(unsupported, k)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("Unsupported schema keyword: %s", strings.Join(unsupported, ", "))
+	}
+	type plain jsonSchema
+	return json.Unmarshal(data, (*plain)(js))
+}
+
+var schemaTypes = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true, "object": true, "array": true, "null": true,
+}
+
+// loadSchemaFile reads and compiles the JSON Schema in the named file.
+func loadSchemaFile(filename string) (*schema, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var js jsonSchema
+	if err = json.Unmarshal(data, &js); err != nil {
+		return nil, fmt.Errorf("Invalid schema %s: %s", filename, err.Error())
+	}
+	s, err := js.compile()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema %s: %s", filename, err.Error())
+	}
+	return s, nil
+}
+
+func (js *jsonSchema) compile() (*schema, error) {
+	s := &schema{
+		required:  js.Required,
+		enum:      js.Enum,
+		minimum:   js.Minimum,
+		maximum:   js.Maximum,
+		minLength: js.MinLength,
+		maxLength: js.MaxLength,
+		minItems:  js.MinItems,
+		maxItems:  js.MaxItems,
+	}
+
+	if len(js.Type) > 0 {
+		if err := json.Unmarshal(js.Type, &s.types); err != nil {
+			var t string
+			if err = json.Unmarshal(js.Type, &t); err != nil {
+				return nil, fmt.Errorf("type must be a string or a list of strings")
+			}
+			s.types = []string{t}
+		}
+		for _, t := range s.types {
+			if !schemaTypes[t] {
+				return nil, fmt.Errorf("Unknown type: %s", t)
+			}
+		}
+	}
+
+	if len(js.Properties) > 0 {
+		s.properties = make(map[string]*schema, len(js.Properties))
+		for name, prop := range js.Properties {
+			compiled, err := prop.compile()
+			if err != nil {
+				return nil, err
+			}
+			s.properties[name] = compiled
+		}
+	}
+
+	if len(js.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(js.AdditionalProperties, &allowed); err == nil {
+			s.noAdditional = !allowed
+		} else {
+			var additional jsonSchema
+			if err = json.Unmarshal(js.AdditionalProperties, &additional); err != nil {
+				if _, isType := err.(*json.UnmarshalTypeError); !isType {
+					return nil, err
+				}
+				return nil, fmt.Errorf("additionalProperties must be a boolean or a schema")
+			}
+			if s.additionalProperties, err = additional.compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if js.Items != nil {
+		var err error
+		if s.items, err = js.Items.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if js.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(js.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// typeSpecSchema builds a schema from a map of dotted paths to type names. A type ending in "?"
+// is optional; other paths, and the objects leading to them, are required, except for objects
+// that are declared optional, which only need the paths below them when they are present.
+func typeSpecSchema(spec map[string]string) (*schema, error) {
+	root := &schema{types: []string{"object"}}
+	paths := make([]string, 0, len(spec))
+	for path := range spec {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		typeName := spec[path]
+		optional := strings.HasSuffix(typeName, "?")
+		typeName = strings.TrimSuffix(typeName, "?")
+		if !schemaTypes[typeName] {
+			return nil, fmt.Errorf("Unknown schema type for %s: %s", path, spec[path])
+		}
+
+		node := root
+		keys := strings.Split(path, ".")
+		for i, key := range keys {
+			if node.properties == nil {
+				node.properties = map[string]*schema{}
+			}
+			child, exists := node.properties[key]
+			if !exists {
+				child = &schema{types: []string{"object"}}
+				node.properties[key] = child
+			}
+			last := i == len(keys)-1
+			if last {
+				child.types = []string{typeName}
+				if optional {
+					child.types = append(child.types, "null")
+				}
+			}
+			// Objects leading to a path are required unless they were declared optional themselves.
+			required := !optional
+			if !last {
+				required = !strings.HasSuffix(spec[strings.Join(keys[:i+1], ".")], "?")
+			}
+			if required && !containsString(node.required, key) {
+				node.required = append(node.required, key)
+			}
+			node = child
+		}
+	}
+	return root, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaViolation is a value that doesn't match the schema. Missing values can't be fixed by
+// dropping anything, so they are reported with missing set.
+type schemaViolation struct {
+	path    string
+	missing bool
+	err     error
+}
+
+// validate checks val against the schema, returning the violations found below path.
+func (s *schema) validate(val interface{}, path string) []schemaViolation {
+	// Values converted by field_types are checked as the JSON they will be encoded as.
+	switch t := val.(type) {
+	case []byte:
+		val = string(t)
+	case json.RawMessage:
+		val = decodeRawJSON(t)
+	}
+
+	violation := func(format string, args ...interface{}) []schemaViolation {
+		return []schemaViolation{{path: path, err: fmt.Errorf(format, args...)}}
+	}
+
+	if len(s.types) > 0 {
+		actual := schemaTypeOf(val)
+		matched := false
+		for _, t := range s.types {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return violation("Expected %s at %s, got %s", strings.Join(s.types, " or "), displayPath(path), actual)
+		}
+	}
+
+	if len(s.enum) > 0 {
+		matched := false
+		for _, e := range s.enum {
+			if enumEqual(e, val) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return violation("Value at %s is not one of the allowed values", displayPath(path))
+		}
+	}
+
+	switch t := val.(type) {
+	case string:
+		n := utf8.RuneCountInString(t)
+		if s.minLength != nil && n < *s.minLength {
+			return violation("String at %s is shorter than %d", displayPath(path), *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return violation("String at %s is longer than %d", displayPath(path), *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(t) {
+			return violation("String at %s does not match %s", displayPath(path), s.pattern.String())
+		}
+
+	case map[string]interface{}:
+		var violations []schemaViolation
+		for _, name := range s.required {
+			if _, exists := t[name]; !exists {
+				violations = append(violations, schemaViolation{
+					path:    joinPath(path, name),
+					missing: true,
+					err:     fmt.Errorf("Missing required value %s", joinPath(path, name)),
+				})
+			}
+		}
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			childPath := joinPath(path, key)
+			if prop, ok := s.properties[key]; ok {
+				violations = append(violations, prop.validate(t[key], childPath)...)
+			} else if s.additionalProperties != nil {
+				violations = append(violations, s.additionalProperties.validate(t[key], childPath)...)
+			} else if s.noAdditional {
+				violations = append(violations, schemaViolation{path: childPath, err: fmt.Errorf("Unexpected value %s", childPath)})
+			}
+		}
+		return violations
+
+	case []interface{}:
+		if s.minItems != nil && len(t) < *s.minItems {
+			return violation("Array at %s has fewer than %d items", displayPath(path), *s.minItems)
+		}
+		if s.maxItems != nil && len(t) > *s.maxItems {
+			return violation("Array at %s has more than %d items", displayPath(path), *s.maxItems)
+		}
+		var violations []schemaViolation
+		if s.items != nil {
+			for i, item := range t {
+				violations = append(violations, s.items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+		return violations
+
+	default:
+		if f, ok := schemaNumber(val); ok {
+			if s.minimum != nil && f < *s.minimum {
+				return violation("Number at %s is less than %v", displayPath(path), *s.minimum)
+			}
+			if s.maximum != nil && f > *s.maximum {
+				return violation("Number at %s is greater than %v", displayPath(path), *s.maximum)
+			}
+		}
+	}
+	return nil
+}
+
+func schemaTypeOf(val interface{}) string {
+	switch t := val.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case int64:
+		return "integer"
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := t.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case float64:
+		if t == math.Trunc(t) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func schemaNumber(val interface{}) (float64, bool) {
+	switch t := val.(type) {
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case float64:
+		return t, true
+	case int64:
+		return float64(t), true
+	}
+	return 0, false
+}
+
+// enumEqual compares a value from the schema with a decoded value, treating numbers of any kind
+// as equal if their values are.
+func enumEqual(want, val interface{}) bool {
+	if w, ok := schemaNumber(want); ok {
+		v, ok := schemaNumber(val)
+		return ok && v == w
+	}
+	return reflect.DeepEqual(want, val)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "top level"
+	}
+	return path
+}
@@ -0,0 +1,147 @@
+package hekalocal
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// severityNames are the syslog severity keywords, and the names written for their numbers.
+var severityNames = []struct {
+	name     string
+	severity int32
+}{
+	{"alert", 1},
+	{"crit", 2},
+	{"err", 3},
+	{"warning", 4},
+	{"notice", 5},
+	{"info", 6},
+	{"debug", 7},
+	{"emerg", 0},
+}
+
+// severityAliases are other common names for the syslog severities.
+var severityAliases = map[string]int32{
+	"emergency":     0,
+	"panic":         0,
+	"critical":      2,
+	"fatal":         2,
+	"error":         3,
+	"warn":          4,
+	"information":   6,
+	"informational": 6,
+	"trace":         7,
+}
+
+// severityLetters are the single-letter levels written by glog and klog, which would otherwise be
+// ambiguous abbreviations.
+var severityLetters = map[string]int32{
+	"e": 3,
+	"w": 4,
+	"i": 6,
+	"d": 7,
+}
+
+// severityTable converts between severity names and numbers. Names are matched case-insensitively:
+// exactly, then as a glog letter, then as a name followed by other text, then as an abbreviation
+// of names that all have the same number.
+type severityTable struct {
+	numbers map[string]int32
+	names   map[int32]string
+	// byLength holds the keys of numbers, longest first, so that the most specific name wins.
+	byLength []string
+}
+
+// newSeverityTable builds a table from the syslog keywords and aliases plus the custom names,
+// which override the built in ones. A custom name also becomes the name written for its number;
+// if several custom names share a number, the alphabetically first one is used.
+func newSeverityTable(custom map[string]int32) (*severityTable, error) {
+	t := &severityTable{
+		numbers: make(map[string]int32, len(severityNames)+len(severityAliases)+len(custom)),
+		names:   make(map[int32]string, len(severityNames)),
+	}
+	for _, s := range severityNames {
+		t.numbers[s.name] = s.severity
+		t.names[s.severity] = s.name
+	}
+	for name, severity := range severityAliases {
+		t.numbers[name] = severity
+	}
+
+	customNames := make([]string, 0, len(custom))
+	for name := range custom {
+		if name == "" {
+			return nil, fmt.Errorf("Empty severity name")
+		}
+		customNames = append(customNames, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(customNames)))
+	for _, name := range customNames {
+		t.numbers[strings.ToLower(name)] = custom[name]
+		t.names[custom[name]] = name
+	}
+
+	for name := range t.numbers {
+		t.byLength = append(t.byLength, name)
+	}
+	sort.Sort(byLength(t.byLength))
+	return t, nil
+}
+
+type byLength []string
+
+func (s byLength) Len() int      { return len(s) }
+func (s byLength) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool {
+	if len(s[i]) != len(s[j]) {
+		return len(s[i]) > len(s[j])
+	}
+	return s[i] < s[j]
+}
+
+// severity returns the number for a severity name or numeric string.
+func (t *severityTable) severity(level string) (int32, bool) {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if level == "" {
+		return 0, false
+	}
+	if severity, ok := t.numbers[level]; ok {
+		return severity, true
+	}
+	if n, err := strconv.ParseInt(level, 10, 32); err == nil {
+		return int32(n), true
+	}
+	if severity, ok := severityLetters[level]; ok {
+		return severity, true
+	}
+	for _, name := range t.byLength {
+		if strings.HasPrefix(level, name) {
+			return t.numbers[name], true
+		}
+	}
+
+	// An abbreviation such as "e" could be an error or an emergency, so it only counts when every
+	// name it abbreviates has the same number.
+	var (
+		severity int32
+		matched  bool
+	)
+	for name, n := range t.numbers {
+		if !strings.HasPrefix(name, level) {
+			continue
+		}
+		if matched && n != severity {
+			return 0, false
+		}
+		severity, matched = n, true
+	}
+	return severity, matched
+}
+
+// name returns the name written for a severity number.
+func (t *severityTable) name(severity int32) (string, bool) {
+	name, ok := t.names[severity]
+	return name, ok
+}
@@ -0,0 +1,121 @@
+package hekalocal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/OwnLocal/go-strftime"
+)
+
+// strftimeLayouts maps the strftime directives that can be parsed to their Go layout elements.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'f': "000000",
+	'p': "PM",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "-0700",
+	'Z': "MST",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'D': "01/02/06",
+	'R': "15:04",
+	'%': "%",
+}
+
+// goLayoutWords are the words that Go layouts treat as elements rather than literal text.
+var goLayoutWords = []string{"Jan", "Mon", "MST", "PM", "pm"}
+
+// strftimeLayout translates a strftime pattern into a Go time layout. Directives without a Go
+// equivalent, and literal text that Go would read as part of the layout, are rejected.
+func strftimeLayout(pattern string) (string, error) {
+	var layout, literal bytes.Buffer
+	flushLiteral := func() error {
+		text := literal.String()
+		literal.Reset()
+		if strings.IndexAny(text, "0123456789") >= 0 {
+			return fmt.Errorf("Unsupported literal text in timestamp format %s: %s", pattern, text)
+		}
+		for _, word := range goLayoutWords {
+			if strings.Contains(text, word) {
+				return fmt.Errorf("Unsupported literal text in timestamp format %s: %s", pattern, text)
+			}
+		}
+		layout.WriteString(text)
+		return nil
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			literal.WriteByte(pattern[i])
+			continue
+		}
+		if i+1 == len(pattern) {
+			return "", fmt.Errorf("Incomplete directive in timestamp format: %s", pattern)
+		}
+		i++
+		elem, ok := strftimeLayouts[pattern[i]]
+		if !ok {
+			return "", fmt.Errorf("Unsupported directive %%%c in timestamp format: %s", pattern[i], pattern)
+		}
+		if pattern[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		// Go only reads fractional seconds that follow a period.
+		if pattern[i] == 'f' && !strings.HasSuffix(literal.String(), ".") {
+			return "", fmt.Errorf("%%f must follow a period in timestamp format: %s", pattern)
+		}
+		if err := flushLiteral(); err != nil {
+			return "", err
+		}
+		layout.WriteString(elem)
+	}
+	if err := flushLiteral(); err != nil {
+		return "", err
+	}
+	return layout.String(), nil
+}
+
+// strftimeFormatDirectives are the directives that formatTime can write.
+const strftimeFormatDirectives = "AaBbdGHILMmpSVYyZz%"
+
+// checkStrftimeFormat rejects directives in pattern that formatTime can't write. With
+// interpolation, %{Name} is left alone for interpolate.
+func checkStrftimeFormat(pattern string, interpolation bool) error {
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			continue
+		}
+		if i+1 == len(pattern) {
+			return fmt.Errorf("Incomplete directive in time format: %s", pattern)
+		}
+		i++
+		if interpolation && pattern[i] == '{' {
+			continue
+		}
+		if strings.IndexByte(strftimeFormatDirectives, pattern[i]) < 0 {
+			return fmt.Errorf("Unsupported directive %%%c in time format: %s", pattern[i], pattern)
+		}
+	}
+	return nil
+}
+
+// formatTime writes t using the strftime directives in pattern, which must have been checked by
+// checkStrftimeFormat.
+func formatTime(pattern string, t time.Time) string {
+	return strftime.Format(pattern, t)
+}
@@ -2,6 +2,10 @@ package hekalocal
 
 import (
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/mozilla-services/heka/message"
@@ -9,45 +13,422 @@ import (
 )
 
 // UnflattenDecoder converts from fields with dotted names as keys to nested JSON-encoded objects.
-// Currently only supports keys with single dots.
-type UnflattenDecoder struct{}
+// Every separator in a name starts a new level, and levels whose keys are exactly 0..n-1 become
+// arrays, so the fields produced by JSONDecoder with flatten enabled can be turned back into the
+// original objects. Fields with several values become arrays as well.
+type UnflattenDecoder struct {
+	config        *UnflattenDecoderConfig
+	errorPayload  *decodeErrorPayload
+	failurePolicy *failurePolicy
+}
+
+// UnflattenDecoderConfig contains the options for splitting field names and for handling messages
+// that can't be unflattened.
+type UnflattenDecoderConfig struct {
+	// Separator between levels in field names, "." by default.
+	Separator string `toml:"separator"`
+
+	// ConflictMode decides what happens when a name is both a value and an object, as with "a" and
+	// "a.b": "keep" (the default) keeps both, leaving the rest of the object's names flat, "error"
+	// fails the message, "object" drops the value and "scalar" drops the object.
+	ConflictMode string `toml:"conflict_mode"`
+
+	// Only fields whose names start with one of the include_prefixes (or any field, if there are
+	// none) and none of the exclude_prefixes are unflattened. Other fields are left as they are.
+	IncludePrefixes []string `toml:"include_prefixes"`
+	ExcludePrefixes []string `toml:"exclude_prefixes"`
+
+	// KeepOriginalFields leaves the flat fields in the message next to the unflattened ones.
+	KeepOriginalFields bool `toml:"keep_original_fields"`
+
+	// Heka fields can't hold objects, but they can hold several values of one type. With
+	// nested_fields enabled, objects are emitted as one field per value, named by its path, arrays
+	// of strings, numbers or booleans as multi-valued fields, and arrays of objects as multi-valued
+	// JSON fields. Fields keep the representation of the flat fields they came from. Other arrays
+	// are emitted one field per element.
+	NestedFields bool `toml:"nested_fields"`
+
+	// Messages that fail to unflatten get this type and logger. The fail_mode decides whether they
+	// are then passed on ("tag", the default), dropped ("drop"), or returned as an error ("error").
+	ErrorType   string `toml:"error_type"`
+	ErrorLogger string `toml:"error_logger"`
+	FailMode    string `toml:"fail_mode"`
+}
+
+// ConfigStruct is provided to make UnflattenDecoder implement the Heka pipeline.HasConfigStruct interface.
+func (d *UnflattenDecoder) ConfigStruct() interface{} {
+	return new(UnflattenDecoderConfig)
+}
 
 // Init is provided to make UnflattenDecoder implement the Heka pipeline.Plugin interface.
 func (d *UnflattenDecoder) Init(config interface{}) (err error) {
+	if config == nil {
+		config = d.ConfigStruct()
+	}
+	d.config = config.(*UnflattenDecoderConfig)
+	if d.config.Separator == "" {
+		d.config.Separator = "."
+	}
+	switch d.config.ConflictMode {
+	case "":
+		d.config.ConflictMode = "keep"
+	case "keep", "error", "object", "scalar":
+	default:
+		return fmt.Errorf("Unknown conflict_mode: %s", d.config.ConflictMode)
+	}
+	d.errorPayload, _ = newDecodeErrorPayload("drop", 0)
+	d.failurePolicy, err = newFailurePolicy(d.config.ErrorType, d.config.ErrorLogger, d.config.FailMode, "tag")
 	return
 }
 
 // Decode is provided to make UnflattenDecoder implement the Heka pipeline.Decoder interface.
 func (d *UnflattenDecoder) Decode(pack *pipeline.PipelinePack) ([]*pipeline.PipelinePack, error) {
-	var newFields []*message.Field
-	unflat := map[string]map[string]interface{}{}
-	for _, field := range pack.Message.Fields {
-		parts := strings.SplitN(field.GetName(), ".", 2)
-		if len(parts) < 2 {
-			newFields = append(newFields, field)
+	if d.config == nil {
+		if err := d.Init(nil); err != nil {
+			return nil, err
+		}
+	}
+	packs := []*pipeline.PipelinePack{pack}
+	if failure := d.unflatten(pack.Message); failure != nil {
+		if err := d.errorPayload.addDecodeError(pack.Message, failure); err != nil {
+			return nil, err
+		}
+		return d.failurePolicy.filter(packs, []error{failure})
+	}
+	return packs, nil
+}
+
+func (d *UnflattenDecoder) unflatten(msg *message.Message) error {
+	var (
+		plain []*message.Field
+		names []string
+	)
+	tree := map[string]interface{}{}
+	reps := map[string]string{}
+	for _, field := range msg.Fields {
+		keys := strings.Split(field.GetName(), d.config.Separator)
+		if len(keys) < 2 || !d.inScope(field.GetName()) {
+			plain = append(plain, field)
 			continue
 		}
+		if d.config.KeepOriginalFields {
+			plain = append(plain, field)
+		}
+		if _, exists := tree[keys[0]]; !exists {
+			names = append(names, keys[0])
+		}
+		reps[field.GetName()] = field.GetRepresentation()
+		if err := d.insert(tree, keys, unflattenValue(field)); err != nil {
+			return err
+		}
+	}
 
-		m, exists := unflat[parts[0]]
-		if !exists {
-			m = map[string]interface{}{}
-			unflat[parts[0]] = m
+	newFields := make([]*message.Field, 0, len(plain)+len(names))
+	for _, field := range plain {
+		name := field.GetName()
+		if _, exists := tree[name]; exists {
+			switch d.config.ConflictMode {
+			case "error":
+				return newDecodeError("conflict", name, fmt.Errorf("Field is both a value and an object: %s", name))
+			case "object":
+				continue
+			case "scalar":
+				delete(tree, name)
+			}
+			// With "keep", the value and the object are both passed on.
 		}
-		m[parts[1]] = field.GetValue()
+		newFields = append(newFields, field)
 	}
-	for k, v := range unflat {
-		enc, err := json.Marshal(v)
+
+	for _, name := range names {
+		val, exists := tree[name]
+		if !exists {
+			continue
+		}
+		val = arrayify(val)
+		if d.config.NestedFields {
+			nested, err := d.nestedFields(name, val, reps)
+			if err != nil {
+				return err
+			}
+			newFields = append(newFields, nested...)
+			continue
+		}
+		enc, err := json.Marshal(val)
 		if err != nil {
-			return nil, err
+			return newDecodeError("encode", name, err)
 		}
-		field, err := message.NewField(k, enc, "json")
+		field, err := message.NewField(name, enc, "json")
 		if err != nil {
-			return nil, err
+			return newDecodeError("encode", name, err)
 		}
 		newFields = append(newFields, field)
 	}
-	pack.Message.Fields = newFields
-	return []*pipeline.PipelinePack{pack}, nil
+	msg.Fields = newFields
+	return nil
+}
+
+func (d *UnflattenDecoder) inScope(name string) bool {
+	for _, prefix := range d.config.ExcludePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	if len(d.config.IncludePrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range d.config.IncludePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// insert stores val in tree at the path given by keys, creating objects along the way and
+// resolving clashes between values and objects according to the conflict mode.
+func (d *UnflattenDecoder) insert(tree map[string]interface{}, keys []string, val interface{}) error {
+	m := tree
+	for i, key := range keys {
+		existing, exists := m[key]
+		child, isObject := existing.(map[string]interface{})
+		last := i == len(keys)-1
+
+		if exists && isObject == last {
+			// A value where there is an object, or an object where there is a value.
+			switch d.config.ConflictMode {
+			case "keep":
+				if !last {
+					m[strings.Join(keys[i:], d.config.Separator)] = val
+					return nil
+				}
+				flattenInto(m, child, key+d.config.Separator, d.config.Separator)
+			case "error":
+				path := strings.Join(keys[:i+1], d.config.Separator)
+				return newDecodeError("conflict", path, fmt.Errorf("Field is both a value and an object: %s", path))
+			case "object":
+				if last {
+					return nil
+				}
+				exists = false
+			case "scalar":
+				if !last {
+					return nil
+				}
+			}
+		}
+
+		if last {
+			m[key] = val
+			return nil
+		}
+		if !exists {
+			child = map[string]interface{}{}
+			m[key] = child
+		}
+		m = child
+	}
+	return nil
+}
+
+// flattenInto stores every value below obj in m, under its path joined by sep and prefixed with
+// prefix.
+func flattenInto(m, obj map[string]interface{}, prefix, sep string) {
+	for key, val := range obj {
+		if child, ok := val.(map[string]interface{}); ok {
+			flattenInto(m, child, prefix+key+sep, sep)
+			continue
+		}
+		m[prefix+key] = val
+	}
+}
+
+// unflattenValue returns the value of field to store in the nested object, keeping fields that
+// already hold JSON as raw JSON. Fields with several values become arrays.
+func unflattenValue(field *message.Field) interface{} {
+	vals := fieldValues(field)
+	if field.GetRepresentation() == "json" {
+		for i, val := range vals {
+			if b, ok := val.([]byte); ok {
+				vals[i] = json.RawMessage(b)
+			}
+		}
+	}
+	if len(vals) == 1 {
+		return vals[0]
+	}
+	return vals
+}
+
+// fieldValues returns every value of field.
+func fieldValues(field *message.Field) []interface{} {
+	var vals []interface{}
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.GetValueString() {
+			vals = append(vals, v)
+		}
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			vals = append(vals, v)
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			vals = append(vals, v)
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			vals = append(vals, v)
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// nestedFields returns the fields for val, named by their paths below name. reps holds the
+// representations of the flat fields.
+func (d *UnflattenDecoder) nestedFields(name string, val interface{}, reps map[string]string) ([]*message.Field, error) {
+	switch t := val.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var fields []*message.Field
+		for _, key := range keys {
+			nested, err := d.nestedFields(name+d.config.Separator+key, t[key], reps)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, nested...)
+		}
+		return fields, nil
+
+	case []interface{}:
+		// The elements either came from one multi-valued field or from one flat field each.
+		representation, sameRep := reps[name]
+		if !sameRep {
+			sameRep = true
+			for i := range t {
+				rep := reps[name+d.config.Separator+strconv.Itoa(i)]
+				if i == 0 {
+					representation = rep
+				} else if rep != representation {
+					sameRep = false
+				}
+			}
+		}
+		if sameRep {
+			if field := multiValueField(name, t, representation); field != nil {
+				return []*message.Field{field}, nil
+			}
+		}
+		if field := objectsField(name, t); field != nil {
+			return []*message.Field{field}, nil
+		}
+		var fields []*message.Field
+		for i, elem := range t {
+			elemName := name + d.config.Separator + strconv.Itoa(i)
+			if _, exists := reps[elemName]; !exists {
+				// An element of a multi-valued field.
+				reps[elemName] = reps[name]
+			}
+			nested, err := d.nestedFields(elemName, elem, reps)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, nested...)
+		}
+		return fields, nil
+
+	case json.RawMessage:
+		val = []byte(t)
+	}
+
+	field, err := message.NewField(name, val, reps[name])
+	if err != nil {
+		return nil, newDecodeError("encode", name, err)
+	}
+	return []*message.Field{field}, nil
+}
+
+// multiValueField returns a field holding every element of val, or nil if val isn't an array of
+// strings, numbers or booleans all of the same type.
+func multiValueField(name string, val interface{}, representation string) *message.Field {
+	arr, ok := val.([]interface{})
+	if !ok || len(arr) == 0 {
+		return nil
+	}
+	first := reflect.TypeOf(arr[0])
+	switch arr[0].(type) {
+	case string, int64, float64, bool:
+	default:
+		return nil
+	}
+	for _, elem := range arr[1:] {
+		if reflect.TypeOf(elem) != first {
+			return nil
+		}
+	}
+
+	field, err := message.NewField(name, arr[0], representation)
+	if err != nil {
+		return nil
+	}
+	for _, elem := range arr[1:] {
+		if field.AddValue(elem) != nil {
+			return nil
+		}
+	}
+	return field
+}
+
+// objectsField returns a field holding every element of arr as a JSON object, or nil if arr
+// holds anything else.
+func objectsField(name string, arr []interface{}) *message.Field {
+	var field *message.Field
+	for _, elem := range arr {
+		if _, ok := elem.(map[string]interface{}); !ok {
+			return nil
+		}
+		enc, err := json.Marshal(elem)
+		if err != nil {
+			return nil
+		}
+		if field == nil {
+			if field, err = message.NewField(name, enc, "json"); err != nil {
+				return nil
+			}
+		} else if field.AddValue(enc) != nil {
+			return nil
+		}
+	}
+	return field
+}
+
+// arrayify replaces every object below val whose keys are exactly "0" to "n-1" with an array.
+func arrayify(val interface{}) interface{} {
+	m, ok := val.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return val
+	}
+	for key, child := range m {
+		m[key] = arrayify(child)
+	}
+
+	arr := make([]interface{}, len(m))
+	for key, child := range m {
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(arr) || strconv.Itoa(i) != key {
+			return m
+		}
+		arr[i] = child
+	}
+	return arr
 }
 
 func init() {
@@ -1,6 +1,7 @@
 package hekalocal_test
 
 import (
+	"math"
 	"testing"
 
 	"github.com/OwnLocal/heka-plugins"
@@ -19,6 +20,12 @@ func TestUnflattenDecoder(t *testing.T) {
 		{fields{newField("a.b", 42.0, ""), newField("a.d", "foo", "")}, fields{newField("a", []byte(`{"b":42,"d":"foo"}`), "json")}},
 		{fields{newField("a", 42.0, "")}, fields{newField("a", 42.0, "")}},
 		{fields{newField("a.b", 42.0, ""), newField("c", "d", "")}, fields{newField("c", "d", ""), newField("a", []byte(`{"b":42}`), "json")}},
+		{fields{newField("a.b.c", 1.0, ""), newField("a.b.d", 2.0, ""), newField("a.e", 3.0, "")}, fields{newField("a", []byte(`{"b":{"c":1,"d":2},"e":3}`), "json")}},
+		{fields{newField("tags.1", "y", ""), newField("tags.0", "x", "")}, fields{newField("tags", []byte(`["x","y"]`), "json")}},
+		{fields{newField("a.0.b", 1.0, ""), newField("a.1.b", 2.0, "")}, fields{newField("a", []byte(`[{"b":1},{"b":2}]`), "json")}},
+		{fields{newField("a.0", 1.0, ""), newField("a.2", 2.0, "")}, fields{newField("a", []byte(`{"0":1,"2":2}`), "json")}},
+		{fields{newField("a.b", []byte(`[1,{"c":null}]`), "json")}, fields{newField("a", []byte(`{"b":[1,{"c":null}]}`), "json")}},
+		{fields{newField("b.x", 1.0, ""), newField("a.x", 2.0, "")}, fields{newField("b", []byte(`{"x":1}`), "json"), newField("a", []byte(`{"x":2}`), "json")}},
 	}
 
 	d := hekalocal.UnflattenDecoder{}
@@ -31,3 +38,201 @@ func TestUnflattenDecoder(t *testing.T) {
 		Expect(packs[0].Message.Fields).To(Equal([]*message.Field(c.want)))
 	}
 }
+
+func TestUnflattenDecoderFailMode(t *testing.T) {
+	RegisterTestingT(t)
+	cases := []struct {
+		mode      string
+		wantPacks int
+		wantErr   bool
+	}{
+		{"", 1, false},
+		{"tag", 1, false},
+		{"drop", 0, false},
+		{"error", 0, true},
+	}
+
+	for _, c := range cases {
+		d := hekalocal.UnflattenDecoder{}
+		Expect(d.Init(&hekalocal.UnflattenDecoderConfig{ErrorType: "unflatten_failure", FailMode: c.mode})).To(Succeed())
+		pack := &pipeline.PipelinePack{}
+		pack.Message = &message.Message{Fields: fields{newField("a.b", math.NaN(), "")}}
+		packs, err := d.Decode(pack)
+		Expect(packs).To(HaveLen(c.wantPacks))
+		Expect(err != nil).To(Equal(c.wantErr))
+		if c.wantPacks > 0 {
+			Expect(packs[0].Message.GetType()).To(Equal("unflatten_failure"))
+			Expect(packs[0].Message.FindFirstField("decode_error.path").GetValue()).To(Equal("a"))
+		}
+	}
+}
+
+func TestUnflattenDecoderSeparator(t *testing.T) {
+	RegisterTestingT(t)
+	d := hekalocal.UnflattenDecoder{}
+	Expect(d.Init(&hekalocal.UnflattenDecoderConfig{Separator: "__"})).To(Succeed())
+
+	pack := &pipeline.PipelinePack{}
+	pack.Message = &message.Message{Fields: fields{newField("a__b.c", 1.0, ""), newField("d.e", 2.0, "")}}
+	packs, err := d.Decode(pack)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.Fields).To(Equal([]*message.Field{
+		newField("d.e", 2.0, ""),
+		newField("a", []byte(`{"b.c":1}`), "json"),
+	}))
+}
+
+func TestUnflattenDecoderConflicts(t *testing.T) {
+	RegisterTestingT(t)
+	cases := []struct {
+		mode     string
+		in       fields
+		want     fields
+		wantPath string
+	}{
+		{"", fields{newField("a", 1.0, ""), newField("a.b", 2.0, "")}, fields{newField("a", 1.0, ""), newField("a", []byte(`{"b":2}`), "json")}, ""},
+		{"keep", fields{newField("a.b", 2.0, ""), newField("a.b.c", 3.0, "")}, fields{newField("a", []byte(`{"b":2,"b.c":3}`), "json")}, ""},
+		{"keep", fields{newField("a.b.c", 3.0, ""), newField("a.b.d", 4.0, ""), newField("a.b", 2.0, "")}, fields{newField("a", []byte(`{"b":2,"b.c":3,"b.d":4}`), "json")}, ""},
+		{"error", fields{newField("a", 1.0, ""), newField("a.b", 2.0, "")}, nil, "a"},
+		{"error", fields{newField("a.b", 2.0, ""), newField("a.b.c", 3.0, "")}, nil, "a.b"},
+		{"error", fields{newField("a.b.c", 3.0, ""), newField("a.b", 2.0, "")}, nil, "a.b"},
+		{"object", fields{newField("a", 1.0, ""), newField("a.b", 2.0, "")}, fields{newField("a", []byte(`{"b":2}`), "json")}, ""},
+		{"object", fields{newField("a.b", 2.0, ""), newField("a.b.c", 3.0, "")}, fields{newField("a", []byte(`{"b":{"c":3}}`), "json")}, ""},
+		{"object", fields{newField("a.b.c", 3.0, ""), newField("a.b", 2.0, "")}, fields{newField("a", []byte(`{"b":{"c":3}}`), "json")}, ""},
+		{"scalar", fields{newField("a", 1.0, ""), newField("a.b", 2.0, "")}, fields{newField("a", 1.0, "")}, ""},
+		{"scalar", fields{newField("a.b", 2.0, ""), newField("a.b.c", 3.0, "")}, fields{newField("a", []byte(`{"b":2}`), "json")}, ""},
+		{"scalar", fields{newField("a.b.c", 3.0, ""), newField("a.b", 2.0, "")}, fields{newField("a", []byte(`{"b":2}`), "json")}, ""},
+	}
+
+	for _, c := range cases {
+		d := hekalocal.UnflattenDecoder{}
+		Expect(d.Init(&hekalocal.UnflattenDecoderConfig{ConflictMode: c.mode, FailMode: "tag"})).To(Succeed())
+		pack := &pipeline.PipelinePack{}
+		pack.Message = &message.Message{Fields: c.in}
+		packs, err := d.Decode(pack)
+		Expect(err).NotTo(HaveOccurred())
+		if c.wantPath != "" {
+			Expect(packs[0].Message.FindFirstField("decode_error.kind").GetValue()).To(Equal("conflict"))
+			Expect(packs[0].Message.FindFirstField("decode_error.path").GetValue()).To(Equal(c.wantPath))
+			continue
+		}
+		Expect(packs[0].Message.Fields).To(Equal([]*message.Field(c.want)))
+	}
+
+	d := hekalocal.UnflattenDecoder{}
+	Expect(d.Init(&hekalocal.UnflattenDecoderConfig{ConflictMode: "merge"})).To(HaveOccurred())
+}
+
+func TestUnflattenDecoderRoundTrip(t *testing.T) {
+	RegisterTestingT(t)
+	jd := hekalocal.JSONDecoder{}
+	Expect(jd.Init(&hekalocal.JSONDecoderConfig{Flatten: true})).To(Succeed())
+	d := hekalocal.UnflattenDecoder{}
+	Expect(d.Init(d.ConfigStruct())).To(Succeed())
+
+	in := `{"a": {"b": {"c": 1, "d": [1, {"e": "f"}]}, "g": null}, "h": "i"}`
+	pack := &pipeline.PipelinePack{}
+	pack.Message = &message.Message{Payload: &in}
+	packs, err := jd.Decode(pack)
+	Expect(err).NotTo(HaveOccurred())
+	packs, err = d.Decode(packs[0])
+	Expect(err).NotTo(HaveOccurred())
+
+	field := packs[0].Message.FindFirstField("a")
+	Expect(field.GetRepresentation()).To(Equal("json"))
+	Expect(string(field.GetValue().([]byte))).To(MatchJSON(`{"b": {"c": 1, "d": [1, {"e": "f"}]}, "g": null}`))
+	Expect(packs[0].Message.FindFirstField("h").GetValue()).To(Equal("i"))
+}
+
+func TestUnflattenDecoderMultiValue(t *testing.T) {
+	RegisterTestingT(t)
+	d := hekalocal.UnflattenDecoder{}
+	Expect(d.Init(d.ConfigStruct())).To(Succeed())
+
+	multi := newField("a.b", "x", "")
+	multi.AddValue("y")
+	pack := &pipeline.PipelinePack{}
+	pack.Message = &message.Message{Fields: fields{multi, newField("a.c", int64(1), "count")}}
+	packs, err := d.Decode(pack)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(packs[0].Message.Fields).To(Equal([]*message.Field{newField("a", []byte(`{"b":["x","y"],"c":1}`), "json")}))
+}
+
+func TestUnflattenDecoderNestedFields(t *testing.T) {
+	RegisterTestingT(t)
+	d := hekalocal.UnflattenDecoder{}
+	Expect(d.Init(&hekalocal.UnflattenDecoderConfig{NestedFields: true})).To(Succeed())
+
+	tags := newField("req.tags", "a", "tag")
+	tags.AddValue("b")
+	pack := &pipeline.PipelinePack{}
+	pack.Message = &message.Message{Fields: fields{
+		newField("req.times.0", 1.5, "ms"),
+		newField("req.times.1", 2.5, "ms"),
+		tags,
+		newField("req.user.id", int64(7), "id"),
+		newField("items.0.n", "x", ""),
+		newField("items.1.n", "y", ""),
+	}}
+	packs, err := d.Decode(pack)
+	Expect(err).NotTo(HaveOccurred())
+
+	times := newField("req.times", 1.5, "ms")
+	times.AddValue(2.5)
+	items := newField("items", []byte(`{"n":"x"}`), "json")
+	items.AddValue([]byte(`{"n":"y"}`))
+	Expect(packs[0].Message.Fields).To(Equal([]*message.Field{
+		tags,
+		times,
+		newField("req.user.id", int64(7), "id"),
+		items,
+	}))
+}
+
+func TestUnflattenDecoderOptions(t *testing.T) {
+	RegisterTestingT(t)
+	multi := newField("m", int64(1), "ms")
+	multi.AddValue(int64(2))
+
+	cases := []struct {
+		config *hekalocal.UnflattenDecoderConfig
+		in     fields
+		want   fields
+	}{
+		{
+			&hekalocal.UnflattenDecoderConfig{IncludePrefixes: []string{"a.", "b.c"}},
+			fields{newField("a.x", 1.0, ""), newField("b.c", 2.0, ""), newField("b.d", 3.0, "")},
+			fields{newField("b.d", 3.0, ""), newField("a", []byte(`{"x":1}`), "json"), newField("b", []byte(`{"c":2}`), "json")},
+		},
+		{
+			&hekalocal.UnflattenDecoderConfig{ExcludePrefixes: []string{"a.y"}},
+			fields{newField("a.x", 1.0, ""), newField("a.y.z", 2.0, "")},
+			fields{newField("a.y.z", 2.0, ""), newField("a", []byte(`{"x":1}`), "json")},
+		},
+		{
+			&hekalocal.UnflattenDecoderConfig{KeepOriginalFields: true},
+			fields{newField("a.x", 1.0, ""), newField("c", "d", "")},
+			fields{newField("a.x", 1.0, ""), newField("c", "d", ""), newField("a", []byte(`{"x":1}`), "json")},
+		},
+		{
+			&hekalocal.UnflattenDecoderConfig{NestedFields: true},
+			fields{newField("m.1", int64(2), "ms"), newField("m.0", int64(1), "ms"), newField("o.x", 1.0, "")},
+			fields{multi, newField("o.x", 1.0, "")},
+		},
+		{
+			&hekalocal.UnflattenDecoderConfig{NestedFields: true},
+			fields{newField("m.0", int64(1), "count"), newField("m.1", "two", "")},
+			fields{newField("m.0", int64(1), "count"), newField("m.1", "two", "")},
+		},
+	}
+
+	for _, c := range cases {
+		d := hekalocal.UnflattenDecoder{}
+		Expect(d.Init(c.config)).To(Succeed())
+		pack := &pipeline.PipelinePack{}
+		pack.Message = &message.Message{Fields: c.in}
+		packs, err := d.Decode(pack)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(packs[0].Message.Fields).To(Equal([]*message.Field(c.want)))
+	}
+}
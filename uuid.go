@@ -1,7 +1,9 @@
 package hekalocal
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/pborman/uuid"
 )
@@ -37,3 +39,73 @@ func NewTimestampUUID(timestamp int64, hash []byte) uuid.UUID {
 
 	return uuid
 }
+
+// NewV5HashUUID returns an RFC 4122 version 5 UUID for the provided hash within the namespace.
+// The same hash always gives the same UUID.
+func NewV5HashUUID(namespace uuid.UUID, hash []byte) uuid.UUID {
+	return uuid.NewSHA1(namespace, hash)
+}
+
+// NewV7HashUUID returns an RFC 9562 version 7 UUID, with the timestamp's Unix milliseconds in the
+// first 48 bits and the provided hash filling the random bits.
+func NewV7HashUUID(timestamp int64, hash []byte) uuid.UUID {
+	hash = stretchHash(hash, 10)
+	ms := uint64(timestamp / 1000000)
+
+	uuid := make([]byte, 16)
+	binary.BigEndian.PutUint16(uuid[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(uuid[2:], uint32(ms))
+	uuid[6] = 0x70 | hash[0]&0x0f // Version 7
+	uuid[7] = hash[1]
+	uuid[8] = 0x80 | hash[2]&0x3f // RFC 4122 variant
+	copy(uuid[9:], hash[3:])
+
+	return uuid
+}
+
+// NewV8HashUUID returns an RFC 9562 version 8 UUID laid out like NewTimestampUUID, with the
+// timestamp in the version 1 time fields, but with the version and variant bits set properly
+// rather than replacing hash bytes.
+func NewV8HashUUID(timestamp int64, hash []byte) uuid.UUID {
+	hash = stretchHash(hash, 8)
+	uuid := NewTimestampUUID(timestamp, nil)
+	uuid[6] = 0x80 | uuid[6]&0x0f // Version 8
+	uuid[8] = 0x80 | hash[0]&0x3f // RFC 4122 variant
+	copy(uuid[9:], hash[1:])
+
+	return uuid
+}
+
+// stretchHash extends hashes shorter than n bytes with the SHA-256 of the hash.
+func stretchHash(hash []byte, n int) []byte {
+	if len(hash) >= n {
+		return hash
+	}
+	extra := sha256.Sum256(hash)
+	return append(append([]byte{}, hash...), extra[:]...)
+}
+
+// uuidGenerator makes a UUID for a message from its timestamp and hash.
+type uuidGenerator func(timestamp int64, hash []byte) uuid.UUID
+
+// newUUIDGenerator returns the generator for a uuid_mode: "legacy-v1" (the default), "v5", "v7" or
+// "v8". The namespace is only used by "v5" and defaults to the nil UUID.
+func newUUIDGenerator(mode, namespace string) (uuidGenerator, error) {
+	switch mode {
+	case "", "legacy-v1":
+		return NewTimestampUUID, nil
+	case "v5":
+		space := uuid.NIL
+		if namespace != "" {
+			if space = uuid.Parse(namespace); space == nil {
+				return nil, fmt.Errorf("Invalid uuid_namespace: %s", namespace)
+			}
+		}
+		return func(timestamp int64, hash []byte) uuid.UUID { return NewV5HashUUID(space, hash) }, nil
+	case "v7":
+		return NewV7HashUUID, nil
+	case "v8":
+		return NewV8HashUUID, nil
+	}
+	return nil, fmt.Errorf("Unknown uuid_mode: %s", mode)
+}